@@ -0,0 +1,258 @@
+package main
+
+import (
+	"ha-adapters/pkg/amcrest"
+	"ha-adapters/pkg/comms"
+	"ha-adapters/pkg/comms/homeassistant"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"golang.org/x/exp/maps"
+)
+
+// Object classes the doorbell's IVS can report, and what we call them
+var objectClassNames = map[string]string{
+	"Human":    "Human",
+	"Vehicle":  "Vehicle",
+	"Animal":   "Animal",
+	"NonMotor": "Non-Motor Vehicle",
+}
+
+type binarySensor struct {
+	comms.Sensor
+	state *binaryState
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+}
+
+// Merge into the sensor's attributes, and publish them all
+func (s *binarySensor) updateAttributes(mqtt *comms.Mqtt, update map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	for k, v := range update {
+		s.attributes[k] = v
+	}
+	mqtt.PublishAttributes(&s.Sensor, maps.Clone(s.attributes))
+}
+
+// Turns doorbell events into sensor states. Shared by the live adapter and replays
+type eventAdapter struct {
+	mqtt     *comms.Mqtt
+	ha       *homeassistant.HomeAssistant
+	device   comms.DeviceClass
+	debounce time.Duration
+
+	button, motion *binarySensor
+
+	// Created as the device reports them
+	mu      sync.Mutex
+	classes map[string]*binarySensor // ObjectType ->
+	rules   map[string]*binarySensor // IVS rule name ->
+}
+
+func newEventAdapter(mqtt *comms.Mqtt, ha *homeassistant.HomeAssistant, device comms.DeviceClass, debounce time.Duration, rules []amcrest.IVSRule) *eventAdapter {
+	s := &eventAdapter{
+		mqtt:     mqtt,
+		ha:       ha,
+		device:   device,
+		debounce: debounce,
+		classes:  make(map[string]*binarySensor),
+		rules:    make(map[string]*binarySensor),
+	}
+
+	s.button = s.newSensor(comms.Sensor{
+		DeviceClass:   device,
+		Name:          "Button",
+		Type:          comms.ST_BINARY_SENSOR,
+		Icon:          "mdi:doorbell",
+		HasAttributes: true,
+	}, 0)
+	s.motion = s.newSensor(comms.Sensor{
+		DeviceClass:   device,
+		Name:          "Motion",
+		Type:          comms.ST_BINARY_SENSOR,
+		ClassType:     comms.SC_MOTION,
+		HasAttributes: true,
+	}, debounce)
+
+	for objectType := range objectClassNames {
+		s.classSensor(objectType)
+	}
+	for _, rule := range rules {
+		if rule.Enable && rule.Name != "" {
+			s.ruleSensor(rule.Name)
+		}
+	}
+
+	time.AfterFunc(5*time.Second, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.button.state.Sync()
+		s.motion.state.Sync()
+		for _, sensor := range s.classes {
+			sensor.state.Sync()
+		}
+		for _, sensor := range s.rules {
+			sensor.state.Sync()
+		}
+	})
+
+	return s
+}
+
+// Publish any debounced offs still waiting, eg. at the end of a replay
+func (s *eventAdapter) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.button.state.Flush()
+	s.motion.state.Flush()
+	for _, sensor := range s.classes {
+		sensor.state.Flush()
+	}
+	for _, sensor := range s.rules {
+		sensor.state.Flush()
+	}
+}
+
+// Advertises, and tracks state for, a binary sensor
+func (s *eventAdapter) newSensor(sensor comms.Sensor, debounce time.Duration) *binarySensor {
+	ret := &binarySensor{Sensor: sensor}
+	ret.state = newBinaryState(debounce, func(on bool) {
+		s.mqtt.PublishState(&ret.Sensor, comms.StateStr(on))
+	})
+	advertise(s.ha, &ret.Sensor)
+	return ret
+}
+
+func (s *eventAdapter) classSensor(objectType string) *binarySensor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sensor, ok := s.classes[objectType]; ok {
+		return sensor
+	}
+
+	name, ok := objectClassNames[objectType]
+	if !ok {
+		logrus.Infof("New object class reported: %s", objectType)
+		name = objectType
+	}
+
+	sensor := s.newSensor(s.detectionSensor(name), s.debounce)
+	s.classes[objectType] = sensor
+	return sensor
+}
+
+func (s *eventAdapter) ruleSensor(rule string) *binarySensor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sensor, ok := s.rules[rule]; ok {
+		return sensor
+	}
+	sensor := s.newSensor(s.detectionSensor("Rule "+rule), s.debounce)
+	s.rules[rule] = sensor
+	return sensor
+}
+
+// Motion sensor with the detected object's details as attributes
+func (s *eventAdapter) detectionSensor(name string) comms.Sensor {
+	return comms.Sensor{
+		DeviceClass:   s.device,
+		Name:          name,
+		Type:          comms.ST_BINARY_SENSOR,
+		ClassType:     comms.SC_MOTION,
+		HasAttributes: true,
+	}
+}
+
+func (s *eventAdapter) HandleEvent(event amcrest.Event) {
+	switch event.Code {
+	case "VideoMotion":
+		if event.Action == "Start" {
+			s.motion.updateAttributes(s.mqtt, map[string]interface{}{
+				"index":  event.Index,
+				"region": gjson.Get(event.Data, "RegionName").Value(),
+				"time":   eventTime(event, "").Format(time.RFC3339),
+			})
+		}
+		updateStartStop(s.motion.state, event)
+	case "CrossRegionDetection":
+		s.handleDetection(event)
+	case "_DoTalkAction_":
+		action := gjson.Get(event.Data, "Action").String()
+		if action == "Invite" {
+			s.button.updateAttributes(s.mqtt, map[string]interface{}{
+				"index": event.Index,
+				"time":  eventTime(event, "").Format(time.RFC3339),
+			})
+		}
+		s.button.state.Update(event.Index, action == "Invite")
+	case "NewFile":
+		// Whatever was recorded last, for both
+		update := map[string]interface{}{
+			"last_file": gjson.Get(event.Data, "File").String(),
+		}
+		s.motion.updateAttributes(s.mqtt, update)
+		s.button.updateAttributes(s.mqtt, update)
+	}
+}
+
+// One detection can drive both its object class, and the rule that caught it
+func (s *eventAdapter) handleDetection(event amcrest.Event) {
+	data := gjson.Parse(event.Data)
+
+	var sensors []*binarySensor
+	if objectType := data.Get("Object.ObjectType").String(); objectType != "" {
+		sensors = append(sensors, s.classSensor(objectType))
+	}
+	if rule := data.Get("Name").String(); rule != "" {
+		sensors = append(sensors, s.ruleSensor(rule))
+	}
+
+	for _, sensor := range sensors {
+		if event.Action == "Start" {
+			sensor.updateAttributes(s.mqtt, detectionAttributes(event, data))
+		}
+		updateStartStop(sensor.state, event)
+	}
+}
+
+func detectionAttributes(event amcrest.Event, data gjson.Result) map[string]interface{} {
+	return map[string]interface{}{
+		"index":        event.Index,
+		"time":         eventTime(event, "").Format(time.RFC3339),
+		"object_id":    data.Get("Object.ObjectID").Int(),
+		"object_type":  data.Get("Object.ObjectType").String(),
+		"bounding_box": data.Get("Object.BoundingBox").Value(),
+		"confidence":   data.Get("Object.Confidence").Float(),
+		"rule":         data.Get("Name").String(),
+		"rule_id":      data.Get("RuleID").Int(),
+		"direction":    data.Get("Direction").String(),
+	}
+}
+
+// Anything other than Start/Stop (eg. Pulse) doesn't change state
+func updateStartStop(state *binaryState, event amcrest.Event) {
+	switch event.Action {
+	case "Start":
+		state.Update(event.Index, true)
+	case "Stop":
+		state.Update(event.Index, false)
+	}
+}
+
+// Codes handled by `HandleEvent`
+var adapterEventCodes = []string{"VideoMotion", "CrossRegionDetection", "_DoTalkAction_", "NewFile"}
+
+func (s *eventAdapter) Register(d *amcrest.Dispatcher) {
+	for _, code := range adapterEventCodes {
+		d.Handle(code, 100, s.HandleEvent)
+	}
+}
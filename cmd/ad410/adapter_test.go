@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"ha-adapters/pkg/amcrest"
+	"ha-adapters/pkg/comms"
+	"ha-adapters/pkg/comms/homeassistant"
+	"ha-adapters/pkg/comms/mqtttest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func adapterTest(t *testing.T, rules []amcrest.IVSRule) (*mqtttest.Broker, *comms.Mqtt, *eventAdapter) {
+	broker, err := mqtttest.NewBroker()
+	require.NoError(t, err)
+	t.Cleanup(func() { broker.Close() })
+
+	mqtt, err := comms.NewMqtt(broker.URI(), "", "")
+	require.NoError(t, err)
+	t.Cleanup(func() { mqtt.Close() })
+
+	ha, _ := homeassistant.NewHomeAssistant(mqtt)
+	device := comms.DeviceClass{DeviceName: "Doorbell", Identifier: "ad410-SN1"}
+	return broker, mqtt, newEventAdapter(mqtt, ha, device, 0, rules)
+}
+
+const humanDetection = `{
+	"Name" : "Driveway",
+	"RuleID" : 2,
+	"Direction" : "Enter",
+	"Object" : {
+		"BoundingBox" : [ 2992, 1136, 4960, 5192 ],
+		"Confidence" : 87,
+		"ObjectID" : 542,
+		"ObjectType" : "Human"
+	}
+}`
+
+func TestAdapterDetection(t *testing.T) {
+	broker, mqtt, adapter := adapterTest(t, []amcrest.IVSRule{
+		{Name: "Porch", Enable: true},
+		{Name: "Disabled"},
+	})
+
+	// Every class, and enabled rules, are advertised up front
+	for _, name := range []string{"human", "vehicle", "animal", "non-motor_vehicle", "rule_porch"} {
+		_, ok := broker.Retained("homeassistant/binary_sensor/ha-adapters-ad410-SN1/" + name + "/config")
+		assert.True(t, ok, name)
+	}
+	_, ok := broker.Retained("homeassistant/binary_sensor/ha-adapters-ad410-SN1/rule_disabled/config")
+	assert.False(t, ok)
+
+	adapter.HandleEvent(amcrest.Event{Code: "CrossRegionDetection", Action: "Start", Data: humanDetection})
+	mqtt.Flush()
+
+	human := broker.PublishedTo("ha-adapters/ad410-sn1/human")
+	require.Len(t, human, 1)
+	assert.Equal(t, "on", string(human[0].Payload))
+	rule := broker.PublishedTo("ha-adapters/ad410-sn1/rule_driveway")
+	require.Len(t, rule, 1)
+	assert.Equal(t, "on", string(rule[0].Payload))
+	assert.Empty(t, broker.PublishedTo("ha-adapters/ad410-sn1/vehicle"))
+
+	attrs := broker.PublishedTo("ha-adapters/ad410-sn1/human/attributes")
+	require.Len(t, attrs, 1)
+	var parsed map[string]interface{}
+	require.NoError(t, json.Unmarshal(attrs[0].Payload, &parsed))
+	assert.Equal(t, []interface{}{2992.0, 1136.0, 4960.0, 5192.0}, parsed["bounding_box"])
+	assert.Equal(t, 87.0, parsed["confidence"])
+	assert.Equal(t, "Driveway", parsed["rule"])
+
+	adapter.HandleEvent(amcrest.Event{Code: "CrossRegionDetection", Action: "Stop", Data: humanDetection})
+	mqtt.Flush()
+	human = broker.PublishedTo("ha-adapters/ad410-sn1/human")
+	require.Len(t, human, 2)
+	assert.Equal(t, "off", string(human[1].Payload))
+}
+
+func TestAdapterEventAttributes(t *testing.T) {
+	broker, mqtt, adapter := adapterTest(t, nil)
+
+	adapter.HandleEvent(amcrest.Event{Code: "VideoMotion", Action: "Start", Index: 0, Data: `{"RegionName": ["Region1"], "UTC": 1674212216}`})
+	adapter.HandleEvent(amcrest.Event{Code: "NewFile", Data: `{"File": "/mnt/sd/a.jpg"}`})
+	mqtt.Flush()
+
+	attrs := broker.PublishedTo("ha-adapters/ad410-sn1/motion/attributes")
+	require.Len(t, attrs, 2)
+	var parsed map[string]interface{}
+	require.NoError(t, json.Unmarshal(attrs[1].Payload, &parsed))
+	assert.Equal(t, []interface{}{"Region1"}, parsed["region"])
+	assert.Equal(t, time.Unix(1674212216, 0).Format(time.RFC3339), parsed["time"])
+	assert.Equal(t, "/mnt/sd/a.jpg", parsed["last_file"])
+
+	assert.Len(t, broker.PublishedTo("ha-adapters/ad410-sn1/button/attributes"), 1)
+}
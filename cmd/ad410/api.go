@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ha-adapters/pkg/amcrest"
+	"ha-adapters/pkg/parsers"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Raw, authenticated requests to the doorbell; curl with digest auth, that
+// understands the device's `k=v` responses. For reverse engineering endpoints
+var apiCommand = &cli.Command{
+	Name:  "api",
+	Usage: "Make a raw request to the doorbell's HTTP API",
+	Description: `Paths without a leading / are under /cgi-bin/, eg:
+
+   ad410 api 'magicBox.cgi?action=getSoftwareVersion'
+   ad410 api --json 'configManager.cgi?action=getConfig&name=Lighting_V2'
+   ad410 api -o snap.jpg snapshot.cgi
+   ad410 api 'eventManager.cgi?action=attach&codes=[All]&heartbeat=5'
+
+Multipart responses, like the event stream, are printed part by part until
+interrupted.`,
+	ArgsUsage: "<path>",
+	Action:    runAPI,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "method",
+			Aliases: []string{"X"},
+			Usage:   "HTTP method",
+			Value:   http.MethodGet,
+		},
+		&cli.StringFlag{
+			Name:    "data",
+			Aliases: []string{"d"},
+			Usage:   "Request body. @file to read it from a file, or @- from stdin. Implies POST",
+		},
+		&cli.StringFlag{
+			Name:  "content-type",
+			Usage: "Request body content type. Defaults to JSON if the body looks like it, otherwise a form",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print k=v responses as JSON (one object per part, for multipart)",
+		},
+		&cli.BoolFlag{
+			Name:  "raw",
+			Usage: "Print the body as-is, without parsing",
+		},
+		&cli.BoolFlag{
+			Name:    "include",
+			Aliases: []string{"i"},
+			Usage:   "Print the response status and headers",
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Write the body to a file, eg. for snapshots",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Give up on a response after this long. Multipart streams aren't limited once open",
+			Value: 30 * time.Second,
+		},
+	},
+}
+
+func runAPI(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("expected a path")
+	}
+	uri := c.Args().First()
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/cgi-bin/" + uri
+	}
+
+	url := c.String("ad410-url")
+	if url == "" {
+		return errors.New("ad410-url is required")
+	}
+	// No probing; the point is to poke at things that may not work
+	doorbell := amcrest.NewAmcrest(url, c.String("ad410-username"), c.String("ad410-password"))
+
+	method := c.String("method")
+	var body io.Reader
+	contentType := c.String("content-type")
+	if c.IsSet("data") {
+		data, err := readData(c.String("data"))
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+		if !c.IsSet("method") {
+			method = http.MethodPost
+		}
+		if contentType == "" {
+			contentType = "application/x-www-form-urlencoded"
+			if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+				contentType = "application/json"
+			}
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	ctx, cancelTimeout := context.WithCancel(ctx)
+	defer cancelTimeout()
+	timeout := time.AfterFunc(c.Duration("timeout"), cancelTimeout)
+	defer timeout.Stop()
+
+	resp, err := doorbell.Do(ctx, strings.ToUpper(method), uri, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if c.Bool("include") {
+		fmt.Fprintf(os.Stderr, "%s %s\n", resp.Proto, resp.Status)
+		resp.Header.Write(os.Stderr)
+		fmt.Fprintln(os.Stderr)
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	out := &apiPrinter{w: os.Stdout, json: c.Bool("json"), raw: c.Bool("raw")}
+
+	switch {
+	case c.String("output") != "":
+		err = writeFile(c.String("output"), resp.Body)
+	case strings.HasPrefix(mediaType, "multipart/"):
+		// Held open until the device or an interrupt ends it
+		timeout.Stop()
+		if c.Bool("raw") {
+			_, err = io.Copy(os.Stdout, resp.Body)
+		} else {
+			err = amcrest.ReadMultipart(resp.Body, params["boundary"], func(header textproto.MIMEHeader, data []byte) error {
+				return out.Print(header.Get("Content-Type"), data)
+			})
+		}
+		if ctx.Err() != nil {
+			err = nil
+		}
+	default:
+		var data []byte
+		data, err = io.ReadAll(resp.Body)
+		if err == nil {
+			err = out.Print(mediaType, data)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("http error %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func readData(arg string) ([]byte, error) {
+	switch {
+	case arg == "@-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(arg, "@"):
+		return os.ReadFile(arg[1:])
+	}
+	return []byte(arg), nil
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "Wrote %d bytes to %s\n", n, path)
+	}
+	return err
+}
+
+type apiPrinter struct {
+	w         io.Writer
+	json, raw bool
+}
+
+// Print a body (or part), as JSON or aligned `k = v` lines if it's k=v
+func (s *apiPrinter) Print(contentType string, data []byte) error {
+	text := strings.TrimSpace(string(data))
+	if s.raw || contentType == "application/json" || !isKV(text) {
+		if len(data) > 0 && !isPrintable(data) {
+			_, err := fmt.Fprintf(s.w, "<%d bytes of %s; use --output>\n", len(data), contentType)
+			return err
+		}
+		_, err := fmt.Fprintln(s.w, text)
+		return err
+	}
+
+	// Keeps the device's order, which parsing into a map wouldn't
+	var keys, vals []string
+	width := 0
+	for _, line := range splitKV(text, kvDelim(text)) {
+		k, v := parsers.ParseOneKV(line)
+		keys, vals = append(keys, k), append(vals, v)
+		if len(k) > width {
+			width = len(k)
+		}
+	}
+
+	if s.json {
+		obj := make(map[string]string, len(keys))
+		for i, k := range keys {
+			obj[k] = vals[i]
+		}
+		return json.NewEncoder(s.w).Encode(obj)
+	}
+	for i := range keys {
+		if _, err := fmt.Fprintf(s.w, "%-*s = %s\n", width, keys[i], vals[i]); err != nil {
+			return err
+		}
+	}
+	if len(keys) > 1 {
+		fmt.Fprintln(s.w)
+	}
+	return nil
+}
+
+// Multi-line responses are a k=v per line; events are separated by `;`, and
+// end with `data=` JSON that may itself span lines
+func kvDelim(text string) byte {
+	head := text
+	if idx := strings.Index(text, ";data="); idx >= 0 {
+		head = text[:idx]
+	}
+	if strings.Contains(head, "\n") {
+		return '\n'
+	}
+	return ';'
+}
+
+func splitKV(text string, delim byte) (ret []string) {
+	if delim == '\n' {
+		for _, line := range strings.Split(text, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				ret = append(ret, line)
+			}
+		}
+		return
+	}
+	// Events' `data=` is JSON, which may have a `;` or newlines; it's always
+	// last, so is the rest of the part, as the event parser reads it
+	for text != "" {
+		idx := strings.IndexByte(text, delim)
+		if idx < 0 || strings.HasPrefix(text, "data=") {
+			return append(ret, text)
+		}
+		ret = append(ret, text[:idx])
+		text = text[idx+1:]
+	}
+	return
+}
+
+// Every line is `k=v`, as opposed to eg. "OK" or "Error\r\nBad Request!"
+func isKV(text string) bool {
+	if text == "" {
+		return false
+	}
+	for _, line := range splitKV(text, kvDelim(text)) {
+		idx := strings.IndexByte(line, '=')
+		if idx <= 0 || strings.ContainsAny(line[:idx], " \t") {
+			return false
+		}
+	}
+	return true
+}
+
+func isPrintable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, b := range data {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' {
+			return false
+		}
+	}
+	return true
+}
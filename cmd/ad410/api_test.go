@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIPrinter(t *testing.T) {
+	print := func(json bool, contentType, body string) string {
+		var buf bytes.Buffer
+		out := &apiPrinter{w: &buf, json: json}
+		require.NoError(t, out.Print(contentType, []byte(body)))
+		return buf.String()
+	}
+
+	config := "table.Lighting_V2[0][0][1].Mode=Auto\r\ntable.Lighting_V2[0][0][1].State=Flicker\r\n"
+	assert.Equal(t, "table.Lighting_V2[0][0][1].Mode  = Auto\ntable.Lighting_V2[0][0][1].State = Flicker\n\n", print(false, "text/plain", config))
+	assert.Equal(t, `{"table.Lighting_V2[0][0][1].Mode":"Auto","table.Lighting_V2[0][0][1].State":"Flicker"}`+"\n", print(true, "text/plain", config))
+
+	// Events are `;` separated, with JSON data last
+	event := `Code=CrossRegionDetection;action=Start;index=0;data={"Name": "a;b"}`
+	assert.Equal(t, "Code   = CrossRegionDetection\naction = Start\nindex  = 0\ndata   = {\"Name\": \"a;b\"}\n\n", print(false, "text/plain", event))
+
+	// As the device sends them, with multi-line data
+	event = "Code=CrossRegionDetection;action=Start;index=0;data={\n   \"Name\" : \"a;b\",\n   \"RuleID\" : 2\n}\n"
+	assert.Equal(t, "Code   = CrossRegionDetection\naction = Start\nindex  = 0\ndata   = {\n   \"Name\" : \"a;b\",\n   \"RuleID\" : 2\n}\n\n", print(false, "text/plain", event))
+	assert.Equal(t, `{"Code":"CrossRegionDetection","action":"Start","data":"{\n   \"Name\" : \"a;b\",\n   \"RuleID\" : 2\n}","index":"0"}`+"\n", print(true, "text/plain", event))
+
+	// Not k=v
+	assert.Equal(t, "OK\n", print(true, "text/plain", "OK\r\n"))
+	assert.Equal(t, "Error\r\nBad Request!\n", print(false, "text/plain", "Error\r\nBad Request!"))
+	assert.Equal(t, `{"a": 1}`+"\n", print(true, "application/json", `{"a": 1}`))
+	assert.Equal(t, "<4 bytes of image/jpeg; use --output>\n", print(false, "image/jpeg", "\xff\xd8\x00\x01"))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+State machine for a binary sensor fed by Start/Stop style events. The doorbell
+repeats Starts, sends one per region `Index`, and flaps Start/Stop in quick
+succession, so:
+  - The sensor is on while any index is active; repeats are ignored
+  - Going on publishes immediately; going off waits `offDelay` in case it flaps back
+  - Only real changes to what was last published are published, in order
+*/
+type binaryState struct {
+	mu        sync.Mutex
+	active    map[int]struct{}
+	published *bool
+	offDelay  time.Duration
+	offTimer  *time.Timer
+	publish   func(on bool)
+}
+
+func newBinaryState(offDelay time.Duration, publish func(on bool)) *binaryState {
+	return &binaryState{
+		active:   make(map[int]struct{}),
+		offDelay: offDelay,
+		publish:  publish,
+	}
+}
+
+func (s *binaryState) Update(index int, on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if on {
+		s.active[index] = struct{}{}
+	} else {
+		delete(s.active, index)
+	}
+
+	if len(s.active) > 0 {
+		s.cancelOffLocked()
+		s.publishLocked(true)
+		return
+	}
+
+	if s.offTimer != nil || (s.published != nil && !*s.published) {
+		return // Already going, or gone, off
+	}
+	if s.offDelay <= 0 {
+		s.publishLocked(false)
+		return
+	}
+	s.offTimer = time.AfterFunc(s.offDelay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.offTimer == nil || len(s.active) > 0 {
+			return
+		}
+		s.offTimer = nil
+		s.publishLocked(false)
+	})
+}
+
+// Publish the current state if nothing has been yet, eg. at startup
+func (s *binaryState) Sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.published == nil {
+		s.publishLocked(len(s.active) > 0)
+	}
+}
+
+// Publish a pending off now, rather than waiting out the delay
+func (s *binaryState) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.offTimer == nil {
+		return
+	}
+	s.cancelOffLocked()
+	s.publishLocked(false)
+}
+
+func (s *binaryState) cancelOffLocked() {
+	if s.offTimer != nil {
+		s.offTimer.Stop()
+		s.offTimer = nil
+	}
+}
+
+func (s *binaryState) publishLocked(on bool) {
+	if s.published != nil && *s.published == on {
+		return
+	}
+	s.published = &on
+	s.publish(on)
+}
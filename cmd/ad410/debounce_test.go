@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type publishLog struct {
+	mu     sync.Mutex
+	states []bool
+}
+
+func (s *publishLog) publish(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states = append(s.states, on)
+}
+
+func (s *publishLog) get() []bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bool(nil), s.states...)
+}
+
+func TestBinaryStateDedupe(t *testing.T) {
+	log := &publishLog{}
+	state := newBinaryState(0, log.publish)
+
+	state.Update(0, true)
+	state.Update(0, true)
+	state.Update(1, true)
+	state.Update(0, false) // Index 1 still active
+	state.Update(1, false)
+	state.Update(1, false)
+
+	assert.Equal(t, []bool{true, false}, log.get())
+}
+
+func TestBinaryStateDebounce(t *testing.T) {
+	log := &publishLog{}
+	state := newBinaryState(50*time.Millisecond, log.publish)
+
+	// Flapping stays on
+	state.Update(0, true)
+	state.Update(0, false)
+	state.Update(0, true)
+	state.Update(0, false)
+	assert.Equal(t, []bool{true}, log.get())
+
+	// Then goes off once quiet
+	assert.Eventually(t, func() bool { return len(log.get()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []bool{true, false}, log.get())
+
+	// No repeats
+	state.Update(0, false)
+	time.Sleep(80 * time.Millisecond)
+	assert.Len(t, log.get(), 2)
+}
+
+func TestBinaryStateSync(t *testing.T) {
+	log := &publishLog{}
+	state := newBinaryState(0, log.publish)
+	state.Sync()
+	state.Sync()
+	state.Update(0, false)
+	state.Update(0, true)
+
+	assert.Equal(t, []bool{false, true}, log.get())
+}
+
+func TestBinaryStateFlush(t *testing.T) {
+	log := &publishLog{}
+	state := newBinaryState(time.Hour, log.publish)
+
+	state.Flush()
+	state.Update(0, true)
+	state.Flush() // Still on
+	state.Update(0, false)
+	assert.Equal(t, []bool{true}, log.get())
+
+	state.Flush()
+	assert.Equal(t, []bool{true, false}, log.get())
+	state.Flush()
+	assert.Equal(t, []bool{true, false}, log.get())
+}
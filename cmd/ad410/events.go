@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"ha-adapters/cmd/internal/xcli/climqtt"
+	"ha-adapters/pkg/amcrest"
+	"ha-adapters/pkg/comms"
+	"ha-adapters/pkg/comms/homeassistant"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// Record the doorbell's raw event stream, and replay it later without the device
+var eventsCommand = &cli.Command{
+	Name:  "events",
+	Usage: "Record and replay the doorbell event stream",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "record",
+			Usage:     "Record raw events from the doorbell to a capture file",
+			ArgsUsage: "<capture.jsonl>",
+			Action:    runEventsRecord,
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "duration",
+					Usage: "Stop recording after this long. 0 to record until interrupted",
+				},
+			},
+		},
+		{
+			Name:      "replay",
+			Usage:     "Replay a capture file. Publishes sensor states if mqtt-uri is set, otherwise just logs events",
+			ArgsUsage: "<capture.jsonl>",
+			Action:    runEventsReplay,
+			Flags: []cli.Flag{
+				&cli.Float64Flag{
+					Name:  "speed",
+					Usage: "Playback speed multiplier. 0 to replay without delay",
+					Value: 1,
+				},
+				&cli.StringFlag{
+					Name:  "serial",
+					Usage: "Serial number to publish as, eg. to drive an existing device",
+					Value: "REPLAY",
+				},
+			},
+		},
+	},
+}
+
+func runEventsRecord(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("expected capture file")
+	}
+
+	doorbell, err := connectDoorbell(c)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(c.Args().First(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	doorbell.EventCapture = amcrest.NewCaptureWriter(f)
+
+	stream, err := doorbell.OpenEventStream()
+	if err != nil {
+		return err
+	}
+
+	var timeout <-chan time.Time
+	if d := c.Duration("duration"); d > 0 {
+		timeout = time.After(d)
+	}
+
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+	defer signal.Stop(sigint)
+
+	logrus.Infof("Recording to %s...", f.Name())
+	count := 0
+	for {
+		select {
+		case event, ok := <-stream:
+			if !ok {
+				logrus.Warn("Stream ended")
+				return nil
+			}
+			count++
+			logEvent(event)
+		case <-timeout:
+			logrus.Infof("Recorded %d events", count)
+			return nil
+		case <-sigint:
+			logrus.Infof("Recorded %d events", count)
+			return nil
+		}
+	}
+}
+
+func runEventsReplay(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("expected capture file")
+	}
+
+	f, err := os.Open(c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var adapter *eventAdapter
+	if c.String("mqtt-uri") != "" {
+		mqtt, err := climqtt.BuildClientFromFlags(c)
+		if err != nil {
+			return err
+		}
+		defer mqtt.Close()
+
+		ha, err := homeassistant.NewHomeAssistant(mqtt)
+		if err != nil {
+			return err
+		}
+		defer ha.Close()
+		ha.DeviceDiscovery = c.Bool("ha-device-discovery")
+
+		adapter = newEventAdapter(mqtt, ha, comms.DeviceClass{
+			DeviceName:   c.String("device-name"),
+			Manufacturer: "Amcrest",
+			Model:        "AD410",
+			Identifier:   "ad410-" + c.String("serial"),
+			Version:      "replay",
+		}, c.Duration("debounce"), nil)
+	}
+
+	stop := make(chan struct{})
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+	defer signal.Stop(sigint)
+	go func() {
+		<-sigint
+		close(stop)
+	}()
+
+	count := 0
+	for event := range amcrest.ReplayCapture(f, c.Float64("speed"), stop) {
+		if event.Err != nil {
+			if amcrest.IsMalformedPart(event.Err) {
+				logrus.Warn(event.Err)
+				continue
+			}
+			return event.Err
+		}
+		count++
+		logEvent(event)
+		if adapter != nil {
+			adapter.HandleEvent(event)
+		}
+	}
+	logrus.Infof("Replayed %d events", count)
+
+	// Settle debounced states now; queued publishes are flushed on close
+	if adapter != nil {
+		adapter.Flush()
+	}
+	return nil
+}
+
+func logEvent(event amcrest.Event) {
+	if event.Err != nil {
+		logrus.Warn(event.Err)
+		return
+	}
+	logrus.Infof("Event %s: action=%s index=%d %s", event.Code, event.Action, event.Index, event.Data)
+}
@@ -1,41 +1,59 @@
 package main
 
 import (
+	"errors"
 	"ha-adapters/cmd/internal/xcli"
+	"ha-adapters/cmd/internal/xcli/clihttp"
 	"ha-adapters/cmd/internal/xcli/clilog"
 	"ha-adapters/cmd/internal/xcli/climqtt"
 	"ha-adapters/pkg/amcrest"
 	"ha-adapters/pkg/comms"
 	"ha-adapters/pkg/comms/homeassistant"
+	"ha-adapters/pkg/health"
+	"ha-adapters/pkg/retention"
+	"ha-adapters/pkg/sink"
 	"ha-adapters/pkg/stemplate"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
-	"github.com/tidwall/gjson"
 	"github.com/urfave/cli/v2"
 )
 
+// Set at build time with `-ldflags "-X main.version=..."`
+var version = "dev"
+
 // https://github.com/dchesterton/amcrest2mqtt/blob/9917b41381c62ef32281c0f508caf3254cf76968/src/amcrest2mqtt.py
 // Setting config: https://github.com/rroller/dahua/issues/52
 // Downloading data: https://github.com/rroller/dahua/issues/97
 
 func runAD410(c *cli.Context) error {
+	if c.Bool("version") {
+		cli.ShowVersion(c)
+		return nil
+	}
+
 	var (
-		amcrestUrl      = c.String("ad410-url")
-		amcrestUsername = c.String("ad410-username")
-		amcrestPassword = c.String("ad410-password")
-		deviceName      = c.String("device-name")
-		pollDuration    = c.Duration("ad410-poll")
-		mediaDirTmpl    = mustCompileTemplateOrNil(c.String("media-dir"))
+		deviceName     = c.String("device-name")
+		pollDuration   = c.Duration("ad410-poll")
+		mediaDirTmpl   = mustCompileTemplateOrNil(c.String("media-dir"))
+		mediaRetention = retention.Policy{
+			MaxAge:   c.Duration("media-max-age"),
+			MaxBytes: c.Int64("media-max-mb") * 1024 * 1024,
+			MaxFiles: c.Int("media-max-files"),
+		}
 	)
 
+	checks := health.New()
+	if _, err := clihttp.ListenFromFlags(c, checks); err != nil {
+		logrus.Fatal(err)
+	}
+
 	// setup and connect to doorbell
-	doorbell, err := amcrest.ConnectAmcrest(amcrestUrl, amcrestUsername, amcrestPassword)
+	doorbell, err := connectDoorbell(c)
 	if err != nil {
 		logrus.Fatal(err)
 	}
@@ -55,8 +73,18 @@ func runAD410(c *cli.Context) error {
 		mqtt.Close()
 		logrus.Fatal(err)
 	}
+	ha.DeviceDiscovery = c.Bool("ha-device-discovery")
+	checks.Ready("mqtt", func() error {
+		if !mqtt.IsConnected() {
+			return errors.New("not connected")
+		}
+		return nil
+	})
 	defer ha.Close()
 
+	bridge := homeassistant.NewBridge(ha, "ad410", version)
+	defer bridge.Close()
+
 	device := comms.DeviceClass{
 		DeviceName:   deviceName,
 		Manufacturer: "Amcrest",
@@ -65,32 +93,12 @@ func runAD410(c *cli.Context) error {
 		Version:      doorbell.SoftwareVersion,
 	}
 
-	dButton := comms.Sensor{
-		DeviceClass: device,
-		Name:        "Button",
-		Type:        comms.ST_BINARY_SENSOR,
-		Icon:        "mdi:doorbell",
-	}
-
-	dHuman := comms.Sensor{
-		DeviceClass: device,
-		Name:        "Human",
-		Type:        comms.ST_BINARY_SENSOR,
-		ClassType:   comms.SC_MOTION,
-	}
-
-	dMotion := comms.Sensor{
-		DeviceClass: device,
-		Name:        "Motion",
-		Type:        comms.ST_BINARY_SENSOR,
-		ClassType:   comms.SC_MOTION,
-	}
-
 	dStorageUsedPercent := comms.Sensor{
 		DeviceClass:       device,
 		Type:              comms.ST_SENSOR,
 		Name:              "Storage Used Percent",
-		UnitOfMeasurement: "%",
+		UnitOfMeasurement: comms.UNIT_PERCENT,
+		StateClass:        comms.STATE_CLASS_MEASUREMENT,
 		Icon:              "mdi:micro-sd",
 		Category:          comms.EC_DIAGNOSTIC,
 	}
@@ -99,7 +107,9 @@ func runAD410(c *cli.Context) error {
 		DeviceClass:       device,
 		Type:              comms.ST_SENSOR,
 		Name:              "Storage Used",
-		UnitOfMeasurement: "GB",
+		UnitOfMeasurement: comms.UNIT_GIGABYTES,
+		ClassType:         comms.SC_DATA_SIZE,
+		StateClass:        comms.STATE_CLASS_MEASUREMENT,
 		Icon:              "mdi:micro-sd",
 		Category:          comms.EC_DIAGNOSTIC,
 	}
@@ -108,7 +118,9 @@ func runAD410(c *cli.Context) error {
 		DeviceClass:       device,
 		Type:              comms.ST_SENSOR,
 		Name:              "Storage Total",
-		UnitOfMeasurement: "GB",
+		UnitOfMeasurement: comms.UNIT_GIGABYTES,
+		ClassType:         comms.SC_DATA_SIZE,
+		StateClass:        comms.STATE_CLASS_MEASUREMENT,
 		Icon:              "mdi:micro-sd",
 		Category:          comms.EC_DIAGNOSTIC,
 	}
@@ -120,67 +132,173 @@ func runAD410(c *cli.Context) error {
 		Name:        "Light",
 	}
 
-	ha.Advertise(&dButton)
-	time.AfterFunc(5*time.Second, func() { mqtt.PublishState(&dButton, comms.STATE_OFF) })
+	dMediaDownload := comms.Sensor{
+		DeviceClass: device,
+		Type:        comms.ST_SENSOR,
+		Name:        "Media Download",
+		Icon:        "mdi:download",
+		JsonPath:    ".status",
+		Category:    comms.EC_DIAGNOSTIC,
+	}
 
-	ha.Advertise(&dHuman)
-	time.AfterFunc(5*time.Second, func() { mqtt.PublishState(&dHuman, comms.STATE_OFF) })
+	dEventStream := comms.Sensor{
+		DeviceClass: device,
+		Type:        comms.ST_SENSOR,
+		Name:        "Event Stream",
+		Icon:        "mdi:lan-connect",
+		JsonPath:    ".status",
+		Category:    comms.EC_DIAGNOSTIC,
+	}
 
-	ha.Advertise(&dMotion)
-	time.AfterFunc(5*time.Second, func() { mqtt.PublishState(&dMotion, comms.STATE_OFF) })
+	dMediaUsage := comms.Sensor{
+		DeviceClass:       device,
+		Type:              comms.ST_SENSOR,
+		Name:              "Media Usage",
+		UnitOfMeasurement: comms.UNIT_MEGABYTES,
+		ClassType:         comms.SC_DATA_SIZE,
+		StateClass:        comms.STATE_CLASS_MEASUREMENT,
+		Icon:              "mdi:harddisk",
+		Category:          comms.EC_DIAGNOSTIC,
+	}
+
+	dMediaFiles := comms.Sensor{
+		DeviceClass: device,
+		Type:        comms.ST_SENSOR,
+		Name:        "Media Files",
+		Icon:        "mdi:file-multiple",
+		StateClass:  comms.STATE_CLASS_MEASUREMENT,
+		Category:    comms.EC_DIAGNOSTIC,
+	}
 
-	ha.Advertise(&dLightSwitch)
+	// Each consumer gets its own queue, so slow downloads don't hold up state
+	dispatch := amcrest.NewDispatcher()
+	dispatch.Log = doorbell.Log
+	dispatch.OnError = func(err error) {
+		logrus.Warn(err)
+		bridge.ReportError(err)
+	}
+	rules, err := doorbell.GetIVSRules()
+	if err != nil {
+		logrus.Warnf("Unable to read IVS rules, rule sensors will be created as they trigger: %v", err)
+	}
+	newEventAdapter(mqtt, ha, device, c.Duration("debounce"), rules).Register(dispatch)
+
+	advertise(ha, &dLightSwitch)
 	time.AfterFunc(5*time.Second, func() { mqtt.PublishState(&dLightSwitch, comms.STATE_OFF) })
 
-	ha.Advertise(&dStorageUsedPercent)
-	ha.Advertise(&dStorageUsed)
-	ha.Advertise(&dStorageTotal)
+	advertise(ha, &dStorageUsedPercent, &dStorageUsed, &dStorageTotal, &dMediaDownload, &dEventStream)
 
 	// Config/events
 	mqtt.SubscribeFunc(dLightSwitch.StateTopic(), func(topic, val string) {
 		doorbell.SetLight(comms.StrState(val))
 	})
 
-	// Core event loop
-	stream := doorbell.OpenReliableEventStream(10)
+	// Media archiving and retention, which also reports usage
+	if mediaDirTmpl != nil {
+		sinks, err := buildSinks(c.StringSlice("media-sink"), mediaDirTmpl.RootDir(), mqtt)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Storing media to: %s", sinks)
+
+		archiver := newMediaArchiver(mediaDirTmpl, c.String("media-staging"), sinks, doorbell, deviceName)
+		defer archiver.Close()
+		dispatch.Handle("NewFile", 100, archiver.Handle)
+
+		go archiver.Run(func(result mediaResult) {
+			status := "ok"
+			errText := ""
+			if result.Err != nil {
+				logrus.Warnf("Failed to archive %s after %d attempts: %v", result.Path, result.Attempts, result.Err)
+				bridge.ReportError(result.Err)
+				metricMediaArchived.With("failed").Inc()
+				status, errText = "failed", result.Err.Error()
+			} else {
+				logrus.Infof("Archived %s as %s (%d bytes)", result.Path, result.Key, result.Bytes)
+				metricMediaArchived.With("ok").Inc()
+				metricMediaBytes.With().Add(float64(result.Bytes))
+			}
+			mqtt.PublishJson(dMediaDownload.StateTopic(), map[string]interface{}{
+				"status":   status,
+				"source":   result.Path,
+				"path":     result.Key,
+				"bytes":    result.Bytes,
+				"attempts": result.Attempts,
+				"error":    errText,
+			})
+		})
+
+		advertise(ha, &dMediaUsage, &dMediaFiles)
+
+		for _, s := range sinks {
+			local, ok := s.(*sink.Local)
+			if !ok {
+				continue
+			}
+			if local.Root == "." || local.Root == "/" {
+				logrus.Warnf("Media dir has no fixed root directory, retention disabled")
+				continue
+			}
+
+			stopRetention := make(chan struct{})
+			defer close(stopRetention)
+
+			policy := mediaRetention
+			policy.Match = archiver.Owns
+			go retention.Run(local.Root, policy, c.Duration("media-prune-interval"), stopRetention, func(result retention.Result, err error) {
+				if err != nil {
+					logrus.Warnf("Error enforcing media retention: %v", err)
+					bridge.ReportError(err)
+					return
+				}
+				metricLastPoll.With("retention").SetToCurrentTime()
+				if result.Removed > 0 {
+					logrus.Infof("Media retention removed %d files (%d bytes)", result.Removed, result.RemovedBytes)
+				}
+				mqtt.PublishValue(&dMediaUsage, strconv.FormatFloat(float64(result.Bytes)/1024.0/1024.0, 'f', 1, 64))
+				mqtt.PublishValue(&dMediaFiles, strconv.Itoa(result.Files))
+			})
+		}
+	}
+
+	// Core event loop; reconnects forever, reporting how it's going
+	// Briefly dropping is normal, being down for a while means we're wedged
+	streamStatus := health.NewStatus()
+	checks.Ready("stream:"+deviceName, streamStatus.CheckUp)
+	checks.Live("stream:"+deviceName, streamStatus.CheckDownFor(c.Duration("health-stream-grace")))
+
+	doorbell.OnStreamStatus = func(state amcrest.StreamState) {
+		connected := state.Status == amcrest.STREAM_CONNECTED
+		streamStatus.Set(connected, state.Err)
+		bridge.DeviceConnected(device, connected)
+		errText := ""
+		if state.Err != nil {
+			errText = state.Err.Error()
+			bridge.ReportError(state.Err)
+		}
+		mqtt.PublishJson(dEventStream.StateTopic(), map[string]interface{}{
+			"status":  state.Status,
+			"attempt": state.Attempt,
+			"error":   errText,
+		})
+	}
+	doorbell.EventCodes = dispatch.Codes()
+	go dispatch.Run(doorbell.OpenReliableEventStream(0))
 
 	// exit signal
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, os.Interrupt)
 	defer signal.Stop(sigint)
 
+	storagePoll := health.NewHeartbeat()
+	checks.Live("poll:storage", storagePoll.Check(3*pollDuration))
+
 	metadataTicker := time.NewTicker(pollDuration)
 	defer metadataTicker.Stop()
 
 LOOP:
 	for {
 		select {
-		case event, ok := <-stream:
-			if !ok || event.Err != nil {
-				logrus.Warnf("Stream ended, aborting.")
-				break LOOP
-			}
-
-			switch event.Code {
-			case "VideoMotion":
-				go mqtt.PublishState(&dMotion, comms.StateStr(event.Action == "Start"))
-			case "CrossRegionDetection":
-				if gjson.Get(event.Data, "Object.ObjectType").String() == "Human" {
-					go mqtt.PublishState(&dHuman, comms.StateStr(event.Action == "Start"))
-				}
-			case "_DoTalkAction_":
-				state := comms.StateStr(gjson.Get(event.Data, "Action").String() == "Invite")
-				go mqtt.PublishState(&dButton, state)
-			case "NewFile":
-				camPath := gjson.Get(event.Data, "File").String()
-				// There are also `.mp4`, but they seem poorly encoded. I currently can't
-				// get them to decode (moov atom error)
-				if mediaDirTmpl != nil && strings.EqualFold(filepath.Ext(camPath), ".jpg") {
-					outDir := mediaDirTmpl.Execute(struct{}{})
-					os.MkdirAll(filepath.Dir(outDir), 0770)
-					go doorbell.DownloadFileTo(camPath, outDir)
-				}
-			}
 		case <-sigint:
 			logrus.Info("Received interrupt")
 			break LOOP
@@ -191,6 +309,8 @@ LOOP:
 				info, err := doorbell.GetStorageInfo()
 				if err == nil {
 					logrus.Debug(info)
+					metricLastPoll.With("storage").SetToCurrentTime()
+					storagePoll.Beat()
 					totalBytes, err0 := strconv.ParseFloat(info["list.info[0].Detail[0].TotalBytes"], 64)
 					usedBytes, err1 := strconv.ParseFloat(info["list.info[0].Detail[0].UsedBytes"], 64)
 					if err0 == nil && err1 == nil {
@@ -210,6 +330,28 @@ LOOP:
 	return nil
 }
 
+func connectDoorbell(c *cli.Context) (*amcrest.AmcrestDevice, error) {
+	url := c.String("ad410-url")
+	if url == "" {
+		return nil, errors.New("ad410-url is required")
+	}
+	device, err := amcrest.ConnectAmcrest(url, c.String("ad410-username"), c.String("ad410-password"))
+	if err != nil {
+		return nil, err
+	}
+	device.EventHeartbeat = c.Duration("ad410-heartbeat")
+	return device, nil
+}
+
+// A bad sensor definition is our bug, but not worth dying over
+func advertise(ha *homeassistant.HomeAssistant, sensors ...*comms.Sensor) {
+	for _, sensor := range sensors {
+		if err := ha.Advertise(sensor); err != nil {
+			logrus.Errorf("Unable to advertise sensor: %v", err)
+		}
+	}
+}
+
 func mustCompileTemplateOrNil(text string) *stemplate.STemplate {
 	if text == "" {
 		return nil
@@ -222,16 +364,14 @@ func mustCompileTemplateOrNil(text string) *stemplate.STemplate {
 }
 
 func main() {
-	logrus.SetFormatter(&logrus.TextFormatter{DisableQuote: true, FullTimestamp: true})
-
 	app := cli.NewApp()
 	app.Usage = "Amcrest AD410 to MQTT (Home-assistant)"
-	app.Flags = xcli.JoinFlags(climqtt.Flags, []cli.Flag{
+	app.Version = version
+	app.Flags = xcli.JoinFlags(climqtt.Flags, clihttp.Flags, []cli.Flag{
 		&cli.StringFlag{
-			Name:     "ad410-url",
-			EnvVars:  []string{"AD410_URL"},
-			Usage:    "URL of the AD410 doorbell",
-			Required: true,
+			Name:    "ad410-url",
+			EnvVars: []string{"AD410_URL"},
+			Usage:   "URL of the AD410 doorbell (required)",
 		},
 		&cli.StringFlag{
 			Name:        "ad410-username",
@@ -249,17 +389,75 @@ func main() {
 			Usage: "Name of device",
 			Value: "Doorbell",
 		},
+		&cli.BoolFlag{
+			Name:    "ha-device-discovery",
+			EnvVars: []string{"HA_DEVICE_DISCOVERY"},
+			Usage:   "Advertise to Home Assistant as a single device discovery payload, rather than one per sensor",
+		},
 		&cli.DurationFlag{
 			Name:  "ad410-poll",
 			Usage: "Duration between update polls",
 			Value: 5 * time.Minute,
 		},
+		&cli.DurationFlag{
+			Name:  "ad410-heartbeat",
+			Usage: "Event stream heartbeat interval; reconnects after missing two. 0 to disable",
+			Value: 10 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "health-stream-grace",
+			Usage: "How long the event stream can be down before /healthz fails",
+			Value: 5 * time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:  "debounce",
+			Usage: "How long motion must stay stopped before it's reported off",
+			Value: 2 * time.Second,
+		},
 		&cli.StringFlag{
 			Name:    "media-dir",
-			Usage:   "Path to write media to. Uses path template. If empty, don't write",
+			Usage:   "Path to write media to. Uses path template with event fields, eg. /media/{{.Device}}/{{.Time | date \"2006-01-02\"}}/{{.Event}}-{{.Base}}{{.Ext}}. If empty, don't write",
 			EnvVars: []string{"MEDIA_DIR"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "media-sink",
+			Usage:   "Where to store media: file, file:///path, s3://bucket/prefix?endpoint=..., webdav(s)://host/path, mqtt://topic. Defaults to file (the media-dir)",
+			EnvVars: []string{"MEDIA_SINKS"},
+		},
+		&cli.StringFlag{
+			Name:  "media-staging",
+			Usage: "Local dir media is downloaded to before being stored",
+			Value: filepath.Join(os.TempDir(), "ha-adapters"),
+		},
+		&cli.DurationFlag{
+			Name:    "media-max-age",
+			Usage:   "Remove media older than this. 0 to keep forever",
+			EnvVars: []string{"MEDIA_MAX_AGE"},
+		},
+		&cli.Int64Flag{
+			Name:    "media-max-mb",
+			Usage:   "Remove oldest media when total exceeds this many MB. 0 for no limit",
+			EnvVars: []string{"MEDIA_MAX_MB"},
+		},
+		&cli.IntFlag{
+			Name:    "media-max-files",
+			Usage:   "Remove oldest media when there are more than this many files. 0 for no limit",
+			EnvVars: []string{"MEDIA_MAX_FILES"},
+		},
+		&cli.DurationFlag{
+			Name:  "media-prune-interval",
+			Usage: "Duration between media retention checks",
+			Value: 1 * time.Hour,
+		},
 	})
+	app.Commands = []*cli.Command{
+		eventsCommand,
+		apiCommand,
+		clihttp.HealthcheckCommand,
+	}
+	// urfave's own version flag is also -v, which is verbose here
+	app.HideVersion = true
+	app.Flags = append(app.Flags, &cli.BoolFlag{Name: "version", Usage: "print the version"})
 	clilog.AdaptForLogSettings(app)
 	app.Action = runAD410
 
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"ha-adapters/pkg/amcrest"
+	"ha-adapters/pkg/comms"
+	"ha-adapters/pkg/sink"
+	"ha-adapters/pkg/stemplate"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// What clips are remuxed to, whatever the template's extension
+const clipExt = ".mp4"
+
+// Downloads media announced by `NewFile` events to a staging dir, then stores
+// it to every sink. Keys are the templated path, relative to the template's root
+type mediaArchiver struct {
+	tmpl       *stemplate.STemplate
+	root       string
+	keys       *regexp.Regexp
+	clipKeys   *regexp.Regexp // Keys, once remuxed to .mp4
+	staging    string
+	sinks      sink.Multi
+	doorbell   *amcrest.AmcrestDevice
+	deviceName string
+	downloader *amcrest.Downloader
+}
+
+type mediaResult struct {
+	amcrest.DownloadResult
+	Key string
+}
+
+func newMediaArchiver(tmpl *stemplate.STemplate, staging string, sinks sink.Multi, doorbell *amcrest.AmcrestDevice, deviceName string) *mediaArchiver {
+	return &mediaArchiver{
+		tmpl:       tmpl,
+		root:       tmpl.RootDir(),
+		keys:       tmpl.KeyPattern(),
+		clipKeys:   tmpl.KeyPatternWithExt(clipExt),
+		staging:    staging,
+		sinks:      sinks,
+		doorbell:   doorbell,
+		deviceName: deviceName,
+		downloader: doorbell.NewDownloader(2, 3),
+	}
+}
+
+// Queue the file from a `NewFile` event, if it's media we keep
+func (s *mediaArchiver) Handle(event amcrest.Event) {
+	camPath := gjson.Get(event.Data, "File").String()
+
+	mediaPath := s.tmpl.Execute(newMediaContext(event, camPath, s.doorbell, s.deviceName))
+	job := amcrest.DownloadJob{Path: camPath}
+
+	switch ext := filepath.Ext(camPath); {
+	case strings.EqualFold(ext, ".jpg"):
+	case strings.EqualFold(ext, ".mp4"), strings.EqualFold(ext, ".dav"):
+		// Clips are recorded as DAV, and remuxed to mp4
+		job.Clip = true
+		mediaPath = strings.TrimSuffix(mediaPath, filepath.Ext(mediaPath)) + clipExt
+	default:
+		return
+	}
+
+	key, err := relativeKey(s.root, mediaPath)
+	if err != nil {
+		logrus.Warnf("Media path %s is outside of %s, skipping", mediaPath, s.root)
+		return
+	}
+	job.To = filepath.Join(s.staging, key)
+
+	if err := s.downloader.Enqueue(job); err != nil {
+		logrus.Warnf("Unable to download %s: %v", camPath, err)
+	}
+}
+
+// Store completed downloads to sinks until closed, reporting each outcome
+func (s *mediaArchiver) Run(report func(mediaResult)) {
+	for result := range s.downloader.Results() {
+		key, err := relativeKey(s.staging, result.To)
+		ret := mediaResult{result, filepath.ToSlash(key)}
+		if ret.Err == nil {
+			ret.Err = err
+		}
+		if ret.Err == nil {
+			ret.Err = s.store(ret.Key, result.To)
+		}
+		report(ret)
+	}
+}
+
+// `path` relative to `root`, erroring if it's outside. `filepath.Rel` happily
+// returns "../.." for those
+func relativeKey(root, path string) (string, error) {
+	key, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+	if key == "." || key == ".." || strings.HasPrefix(key, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", path, root)
+	}
+	return key, nil
+}
+
+// Whether `key` could be media we archived, so retention leaves anything else
+// under the root alone
+func (s *mediaArchiver) Owns(key string) bool {
+	ext := strings.ToLower(path.Ext(key))
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".mp4" {
+		return false
+	}
+	return s.keys.MatchString(key) || (ext == clipExt && s.clipKeys.MatchString(key))
+}
+
+func (s *mediaArchiver) Close() {
+	s.downloader.Close()
+}
+
+func (s *mediaArchiver) store(key, staged string) error {
+	defer os.Remove(staged)
+
+	f, err := os.Open(staged)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return s.sinks.Put(key, f, info.Size())
+}
+
+// Sinks from config, defaulting to local disk under the template root
+func buildSinks(urls []string, localRoot string, publisher *comms.Mqtt) (sink.Multi, error) {
+	if len(urls) == 0 {
+		urls = []string{"file"}
+	}
+
+	var ret sink.Multi
+	for _, u := range urls {
+		s, err := sink.FromURL(u, localRoot, publisher)
+		if err != nil {
+			return nil, fmt.Errorf("media sink: %w", err)
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// Data available to the `--media-dir` template, eg.
+// `/media/{{.Device}}/{{.Time | date "2006-01-02"}}/{{.Event}}-{{.Base}}{{.Ext}}`.
+// Fields are safe as (part of) a single path component, except `Path`, which
+// can't climb above its root
+type mediaContext struct {
+	Event  string // Event code, eg. NewFile
+	Action string
+	Index  int
+
+	Path     string // Original path on the device
+	Filename string // Filename on the device, with extension
+	Base     string // Filename without extension
+	Ext      string // Extension, including "."
+
+	Device string // Device name
+	Serial string
+
+	Time time.Time // When the event happened, according to the device
+}
+
+func newMediaContext(event amcrest.Event, camPath string, device *amcrest.AmcrestDevice, deviceName string) mediaContext {
+	filename := filepath.Base(camPath)
+	ext := filepath.Ext(filename)
+
+	return mediaContext{
+		Event:    pathSafe(event.Code),
+		Action:   pathSafe(event.Action),
+		Index:    event.Index,
+		Path:     path.Clean("/" + camPath),
+		Filename: pathSafe(filename),
+		Base:     pathSafe(strings.TrimSuffix(filename, ext)),
+		Ext:      pathSafe(ext),
+		Device:   pathSafe(deviceName),
+		Serial:   pathSafe(device.SerialNumber),
+		Time:     eventTime(event, camPath),
+	}
+}
+
+var pathSeparators = strings.NewReplacer("/", "_", "\\", "_")
+
+// Values can't add directories, or be "." or ".." themselves. Unlike the
+// template's `sanitize`, anything else (eg. spaces) is kept
+func pathSafe(s string) string {
+	s = pathSeparators.Replace(s)
+	if s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// Prefer the event's own timestamp, then what's encoded in the recording path
+func eventTime(event amcrest.Event, camPath string) time.Time {
+	if utc := gjson.Get(event.Data, "UTC"); utc.Exists() && utc.Int() > 0 {
+		return time.Unix(utc.Int(), 0)
+	}
+	if t, ok := parseCamPathTime(camPath); ok {
+		return t
+	}
+	return time.Now()
+}
+
+// Recordings are stored like:
+//
+//	/mnt/sd/2023-01-20/001/dav/10/10.56.56-10.57.44[M][0@0][0].mp4
+//	/mnt/sd/2023-01-20/001/jpg/10/56/56[M][0@0][0].jpg
+var camPathTimeRegexes = []*regexp.Regexp{
+	regexp.MustCompile(`(\d{4}-\d{2}-\d{2})/.*/(\d{2})\.(\d{2})\.(\d{2})-[^/]*$`),
+	regexp.MustCompile(`(\d{4}-\d{2}-\d{2})/.*/(\d{2})/(\d{2})/(\d{2})[^/]*$`),
+}
+
+func parseCamPathTime(camPath string) (time.Time, bool) {
+	for _, re := range camPathTimeRegexes {
+		if m := re.FindStringSubmatch(camPath); m != nil {
+			t, err := time.ParseInLocation("2006-01-02 15 04 05", strings.Join(m[1:], " "), time.Local)
+			return t, err == nil
+		}
+	}
+	return time.Time{}, false
+}
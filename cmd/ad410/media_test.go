@@ -0,0 +1,173 @@
+package main
+
+import (
+	"ha-adapters/pkg/amcrest"
+	"ha-adapters/pkg/retention"
+	"ha-adapters/pkg/stemplate"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testArchiver(text string) *mediaArchiver {
+	tmpl := stemplate.MustNew(text)
+	return &mediaArchiver{tmpl: tmpl, root: tmpl.RootDir(), keys: tmpl.KeyPattern(), clipKeys: tmpl.KeyPatternWithExt(clipExt)}
+}
+
+func TestMediaOwns(t *testing.T) {
+	s := testArchiver(`/home/user/{{.Device}}-{{.Base}}.jpg`)
+	assert.True(t, s.Owns("Doorbell-56.jpg"))
+	assert.True(t, s.Owns("Doorbell-10.56.56-10.57.44.mp4"), "clip")
+	assert.False(t, s.Owns("holiday.jpg"), "not the template's shape")
+	assert.False(t, s.Owns("Doorbell-notes.txt"), "not media")
+	assert.False(t, s.Owns(".bashrc"))
+
+	s = testArchiver(`/media/{{.Device}}/{{.Base}}{{.Ext}}`)
+	assert.True(t, s.Owns("Doorbell/56.jpg"))
+	assert.True(t, s.Owns("Doorbell/10.56.56-10.57.44.mp4"))
+	assert.False(t, s.Owns("Doorbell/56.dav"), "never kept as dav")
+	assert.False(t, s.Owns("top.jpg"))
+
+	// The camera's own path, whose extension is .mp4 or .dav for clips
+	s = testArchiver(`/media/{{.Device}}/cam{{.Path}}`)
+	assert.True(t, s.Owns("Doorbell/cam/mnt/sd/2023-01-20/001/dav/10/10.56.56-10.57.44.mp4"))
+	assert.False(t, s.Owns("Doorbell/other.mp4"))
+}
+
+func TestMediaRetention(t *testing.T) {
+	root := t.TempDir()
+	s := testArchiver(root + `/{{.Device}}-{{.Base}}.jpg`)
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"Doorbell-56.jpg", "Doorbell-10.56.56-10.57.44.mp4", "holiday.jpg", "Doorbell-notes.txt"} {
+		file := filepath.Join(root, name)
+		require.NoError(t, os.WriteFile(file, []byte("x"), 0644))
+		require.NoError(t, os.Chtimes(file, old, old))
+	}
+
+	// Only the snapshot and the clip are ours to prune
+	result, err := retention.Enforce(root, retention.Policy{MaxAge: time.Hour, Match: s.Owns}, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Removed)
+	assert.NoFileExists(t, filepath.Join(root, "Doorbell-10.56.56-10.57.44.mp4"))
+	assert.FileExists(t, filepath.Join(root, "holiday.jpg"))
+	assert.FileExists(t, filepath.Join(root, "Doorbell-notes.txt"))
+}
+
+func TestParseCamPathTime(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want string // Local time; empty if it shouldn't parse
+	}{
+		{"/mnt/sd/2023-01-20/001/dav/10/10.56.56-10.57.44[M][0@0][0].mp4", "2023-01-20 10:56:56"},
+		{"/mnt/sd/2023-01-20/001/dav/23/23.59.59-00.00.10[M][0@0][0].dav", "2023-01-20 23:59:59"},
+		{"/mnt/sd/2023-01-20/001/jpg/10/56/56[M][0@0][0].jpg", "2023-01-20 10:56:56"},
+		{"/mnt/sd/2023-01-20/001/jpg/07/05/09[M][0@0][0].jpg", "2023-01-20 07:05:09"},
+		{"/mnt/sd/2023-13-45/001/jpg/10/56/56[M][0@0][0].jpg", ""}, // Not a date
+		{"/mnt/sd/2023-01-20/001/jpg/25/56/56[M][0@0][0].jpg", ""}, // Not a time
+		{"/mnt/sd/snapshot.jpg", ""},
+		{"", ""},
+	} {
+		got, ok := parseCamPathTime(tc.path)
+		if tc.want == "" {
+			assert.False(t, ok, tc.path)
+			continue
+		}
+		if assert.True(t, ok, tc.path) {
+			assert.Equal(t, tc.want, got.Format("2006-01-02 15:04:05"), tc.path)
+			assert.Equal(t, time.Local, got.Location(), tc.path)
+		}
+	}
+}
+
+func TestEventTime(t *testing.T) {
+	camPath := "/mnt/sd/2023-01-20/001/jpg/10/56/56[M][0@0][0].jpg"
+
+	// The event's own UTC wins
+	got := eventTime(amcrest.Event{Data: `{"UTC": 1674212216}`}, camPath)
+	assert.Equal(t, int64(1674212216), got.Unix())
+
+	got = eventTime(amcrest.Event{Data: `{"UTC": 0}`}, camPath)
+	assert.Equal(t, "2023-01-20 10:56:56", got.Format("2006-01-02 15:04:05"))
+
+	got = eventTime(amcrest.Event{}, "/mnt/sd/snapshot.jpg")
+	assert.WithinDuration(t, time.Now(), got, time.Minute)
+}
+
+func TestMediaContext(t *testing.T) {
+	device := amcrest.NewAmcrest("http://doorbell", "admin", "")
+	device.SerialNumber = "AD410/1"
+
+	for _, tc := range []struct {
+		event   amcrest.Event
+		camPath string
+		device  string
+		want    mediaContext
+	}{
+		{
+			amcrest.Event{Code: "NewFile", Action: "Pulse", Index: 1},
+			"/mnt/sd/2023-01-20/001/jpg/10/56/56[M][0@0][0].jpg",
+			"Front Door",
+			mediaContext{
+				Event: "NewFile", Action: "Pulse", Index: 1,
+				Path:     "/mnt/sd/2023-01-20/001/jpg/10/56/56[M][0@0][0].jpg",
+				Filename: "56[M][0@0][0].jpg", Base: "56[M][0@0][0]", Ext: ".jpg",
+				Device: "Front Door", Serial: "AD410_1",
+			},
+		},
+		{
+			// Nothing can add directories, or climb out of the root
+			amcrest.Event{Code: "../x", Action: ".."},
+			"/mnt/sd/../../../etc/passwd.jpg",
+			"../../home/user",
+			mediaContext{
+				Event: ".._x", Action: "_",
+				Path:     "/etc/passwd.jpg",
+				Filename: "passwd.jpg", Base: "passwd", Ext: ".jpg",
+				Device: ".._.._home_user", Serial: "AD410_1",
+			},
+		},
+		{
+			amcrest.Event{Code: "NewFile"},
+			`/mnt/sd/a\b.jpg`,
+			"Door",
+			mediaContext{
+				Event:    "NewFile",
+				Path:     `/mnt/sd/a\b.jpg`,
+				Filename: "a_b.jpg", Base: "a_b", Ext: ".jpg",
+				Device: "Door", Serial: "AD410_1",
+			},
+		},
+	} {
+		got := newMediaContext(tc.event, tc.camPath, device, tc.device)
+		got.Time = time.Time{}
+		assert.Equal(t, tc.want, got, tc.camPath)
+	}
+}
+
+func TestRelativeKey(t *testing.T) {
+	for _, tc := range []struct {
+		root, path, want string
+	}{
+		{"/media", "/media/Door/a.jpg", "Door/a.jpg"},
+		{"/media", "/media/..a.jpg", "..a.jpg"},
+		{"/media", "/media/../etc/passwd", ""},
+		{"/media", "/etc/passwd", ""},
+		{"/media", "/media", ""},
+		{"/media", "/", ""},
+		{".", "a/b.jpg", "a/b.jpg"},
+		{".", "../b.jpg", ""},
+	} {
+		key, err := relativeKey(tc.root, tc.path)
+		if tc.want == "" {
+			assert.Error(t, err, tc.path)
+			continue
+		}
+		if assert.NoError(t, err, tc.path) {
+			assert.Equal(t, tc.want, filepath.ToSlash(key))
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import "ha-adapters/pkg/metrics"
+
+var (
+	metricMediaArchived = metrics.NewCounter("ad410_media_archived_total",
+		"Media files archived, by result (ok or failed)", "result")
+	metricMediaBytes = metrics.NewCounter("ad410_media_archived_bytes_total",
+		"Bytes of media archived")
+	metricLastPoll = metrics.NewGauge("ad410_last_poll_timestamp_seconds",
+		"When each poll (storage, retention) last succeeded", "poll")
+)
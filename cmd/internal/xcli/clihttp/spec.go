@@ -0,0 +1,113 @@
+package clihttp
+
+import (
+	"errors"
+	"fmt"
+	"ha-adapters/pkg/health"
+	"ha-adapters/pkg/metrics"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var Flags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "listen",
+		EnvVars: []string{"LISTEN"},
+		Usage:   "Address to serve metrics (/metrics) and health (/healthz, /readyz) on, eg. :9100. Disabled if empty",
+	},
+}
+
+// Start serving if `listen` is set. Returns the mux, so more can be served on
+// it, or nil if not listening
+func ListenFromFlags(c *cli.Context, checks *health.Checks) (*http.ServeMux, error) {
+	addr := c.String("listen")
+	if addr == "" {
+		return nil, nil
+	}
+
+	// Listen up front, so a bad address fails startup
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	if checks != nil {
+		mux.Handle("/healthz", checks.LiveHandler())
+		mux.Handle("/readyz", checks.ReadyHandler())
+	}
+
+	logrus.Infof("Serving metrics and health on %s", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			logrus.Warnf("HTTP listener stopped: %v", err)
+		}
+	}()
+	return mux, nil
+}
+
+// Checks a running adapter's health, eg. for a container HEALTHCHECK
+var HealthcheckCommand = &cli.Command{
+	Name:   "healthcheck",
+	Usage:  "Exit non-zero unless the running adapter is healthy",
+	Action: runHealthcheck,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "url",
+			Usage: "Health URL to check. Defaults to /healthz on the listen address",
+		},
+		&cli.BoolFlag{
+			Name:  "ready",
+			Usage: "Check readiness (/readyz), rather than liveness",
+		},
+	},
+}
+
+func runHealthcheck(c *cli.Context) error {
+	url := c.String("url")
+	if url == "" {
+		path := "/healthz"
+		if c.Bool("ready") {
+			path = "/readyz"
+		}
+		var err error
+		if url, err = localURL(c.String("listen"), path); err != nil {
+			return err
+		}
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return cli.Exit(fmt.Sprintf("unhealthy (%d): %s", resp.StatusCode, body), 1)
+	}
+	fmt.Fprintf(c.App.Writer, "%s", body)
+	return nil
+}
+
+// Where to reach our own listener, from the same host
+func localURL(listen, path string) (string, error) {
+	if listen == "" {
+		return "", errors.New("listen address (or --url) is required")
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port) + path, nil
+}
@@ -1,10 +1,17 @@
 package clilog
 
 import (
+	"fmt"
+	"ha-adapters/pkg/xlog"
+	"strings"
+
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
+// Components that `--log-levels` can set
+var Components = []string{"amcrest", "mqtt", "homeassistant", "xhttp", "retention"}
+
 func AdaptForLogSettings(app *cli.App) {
 	app.Flags = append(app.Flags, []cli.Flag{
 		&cli.BoolFlag{
@@ -16,15 +23,72 @@ func AdaptForLogSettings(app *cli.App) {
 			Name:  "trace",
 			Usage: "Enables trace messages",
 		},
+		&cli.StringFlag{
+			Name:    "log-level",
+			EnvVars: []string{"LOG_LEVEL"},
+			Usage:   "Log level: error, warn, info, debug or trace",
+			Value:   "info",
+		},
+		&cli.StringFlag{
+			Name:    "log-levels",
+			EnvVars: []string{"LOG_LEVELS"},
+			Usage:   "Per-component log levels, eg. xhttp=trace,mqtt=debug. Components: " + strings.Join(Components, ", "),
+		},
+		&cli.StringFlag{
+			Name:    "log-format",
+			EnvVars: []string{"LOG_FORMAT"},
+			Usage:   "Log format: text or json",
+			Value:   "text",
+		},
+		&cli.BoolFlag{
+			Name:    "log-redact",
+			EnvVars: []string{"LOG_REDACT"},
+			Usage:   "Mask credentials, Authorization headers and sensitive keys in logs. Disable only for deep debugging",
+			Value:   true,
+		},
+		&cli.StringSliceFlag{
+			Name:    "log-redact-keys",
+			EnvVars: []string{"LOG_REDACT_KEYS"},
+			Usage:   "More sensitive key names to mask, besides password, token, secret etc.",
+		},
 	}...)
 
 	oldBefore := app.Before
 	app.Before = func(ctx *cli.Context) error {
-		if ctx.Bool("verbose") {
-			logrus.SetLevel(logrus.DebugLevel)
+		var formatter logrus.Formatter
+		switch ctx.String("log-format") {
+		case "text":
+			formatter = &logrus.TextFormatter{DisableQuote: true, FullTimestamp: true}
+		case "json":
+			formatter = &logrus.JSONFormatter{}
+		default:
+			return fmt.Errorf("unknown log-format %q", ctx.String("log-format"))
+		}
+		if ctx.Bool("log-redact") {
+			keys := append([]string{}, xlog.DefaultSensitiveKeys...)
+			keys = append(keys, ctx.StringSlice("log-redact-keys")...)
+			formatter = xlog.NewRedactingFormatter(formatter, keys)
+		}
+		logrus.SetFormatter(formatter)
+
+		level, err := logrus.ParseLevel(ctx.String("log-level"))
+		if err != nil {
+			return err
+		}
+		if ctx.Bool("verbose") && level < logrus.DebugLevel {
+			level = logrus.DebugLevel
 		}
 		if ctx.Bool("trace") {
-			logrus.SetLevel(logrus.TraceLevel)
+			level = logrus.TraceLevel
+		}
+		xlog.SetLevel(level)
+
+		components, err := xlog.ParseLevels(ctx.String("log-levels"), Components...)
+		if err != nil {
+			return err
+		}
+		for name, level := range components {
+			xlog.SetComponentLevel(name, level)
 		}
 
 		if oldBefore != nil {
@@ -1,6 +1,7 @@
 package climqtt
 
 import (
+	"errors"
 	"ha-adapters/pkg/comms"
 
 	"github.com/urfave/cli/v2"
@@ -8,10 +9,9 @@ import (
 
 var Flags = []cli.Flag{
 	&cli.StringFlag{
-		Name:     "mqtt-uri",
-		EnvVars:  []string{"MQTT_URI"},
-		Usage:    "Set MQTT broker in format hostname:port",
-		Required: true,
+		Name:    "mqtt-uri",
+		EnvVars: []string{"MQTT_URI"},
+		Usage:   "Set MQTT broker in format hostname:port (required)",
 	},
 	&cli.StringFlag{
 		Name:    "mqtt-username",
@@ -33,11 +33,16 @@ var Flags = []cli.Flag{
 func BuildClientFromFlags(c *cli.Context) (*comms.Mqtt, error) {
 	var (
 		uri      = c.String("mqtt-uri")
-		username = c.String("username")
-		password = c.String("password")
+		username = c.String("mqtt-username")
+		password = c.String("mqtt-password")
 		qos      = c.Int("qos")
 	)
 
+	// Not a required flag, so subcommands that don't need mqtt can run
+	if uri == "" {
+		return nil, errors.New("mqtt-uri is required")
+	}
+
 	client, err := comms.NewMqtt(uri, username, password)
 	if err != nil {
 		return nil, err
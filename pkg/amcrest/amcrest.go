@@ -1,13 +1,15 @@
 package amcrest
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"ha-adapters/pkg/parsers"
 	"ha-adapters/pkg/xhttp"
+	"ha-adapters/pkg/xlog"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -20,26 +22,90 @@ type AmcrestDevice struct {
 	url                string
 	username, password string
 	digestClient       xhttp.XHttp
+	rawClient          xhttp.XHttp // No retries or timeout, for `Do`
 
 	SerialNumber    string
 	DeviceType      string
 	SoftwareVersion string
+
+	// How often, and how long, to wait on a clip that's still recording
+	ClipPollInterval time.Duration
+	ClipTimeout      time.Duration
+
+	// Event codes to attach to, eg. from `Dispatcher.Codes()`. Empty for all
+	EventCodes []string
+
+	// If set, raw event stream payloads are recorded here
+	EventCapture *CaptureWriter
+
+	// Heartbeat interval requested from the device; the stream is considered
+	// dead after missing two. 0 to disable
+	EventHeartbeat time.Duration
+
+	// Reconnect delays for `OpenReliableEventStream`, and where it reports status
+	StreamBackoff    time.Duration
+	StreamMaxBackoff time.Duration
+	OnStreamStatus   func(StreamState)
+
+	// Has the device's serial once connected
+	Log *logrus.Entry
 }
 
-func ConnectAmcrest(url string, username, password string) (*AmcrestDevice, error) {
+// A device without talking to it, so nothing about it is known yet. Most
+// things want `ConnectAmcrest`
+func NewAmcrest(url string, username, password string) *AmcrestDevice {
 	var httpClient xhttp.XHttp
 	httpClient = &http.Client{
 		Timeout: 5 * time.Second,
 	}
+	httpClient = newInstrumented(httpClient)
 	httpClient = xhttp.NewDigest(httpClient, username, password)
 	httpClient = xhttp.NewAutoRetry(httpClient, 5)
 
-	s := &AmcrestDevice{
+	var rawClient xhttp.XHttp
+	rawClient = &http.Client{}
+	rawClient = newInstrumented(rawClient)
+	rawClient = xhttp.NewDigest(rawClient, username, password)
+
+	return &AmcrestDevice{
 		url:          url,
 		digestClient: httpClient,
+		rawClient:    rawClient,
 		username:     username,
 		password:     password,
+
+		ClipPollInterval: 5 * time.Second,
+		ClipTimeout:      5 * time.Minute,
+		EventHeartbeat:   10 * time.Second,
+		StreamBackoff:    1 * time.Second,
+		StreamMaxBackoff: 1 * time.Minute,
+		Log:              xlog.Component("amcrest"),
 	}
+}
+
+// Metrics by CGI script. Paths can carry a file name (`RPC_Loadfile/mnt/sd/...`),
+// or be anything at all through `ad410 api`; each would be a new series
+func newInstrumented(client xhttp.XHttp) xhttp.XHttp {
+	ret := xhttp.NewInstrumented(client, "amcrest")
+	ret.Endpoint = cgiEndpoint
+	return ret
+}
+
+func cgiEndpoint(req *http.Request) string {
+	const prefix = "/cgi-bin/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		return "other"
+	}
+	script := strings.TrimPrefix(req.URL.Path, prefix)
+	if idx := strings.IndexByte(script, '/'); idx >= 0 {
+		script = script[:idx]
+	}
+	return prefix + script
+}
+
+// Connect to an AD410, fetching its static metadata
+func ConnectAmcrest(url string, username, password string) (*AmcrestDevice, error) {
+	s := NewAmcrest(url, username, password)
 
 	// Static metdata
 	var err error
@@ -47,6 +113,7 @@ func ConnectAmcrest(url string, username, password string) (*AmcrestDevice, erro
 	if err != nil {
 		return nil, err
 	}
+	s.Log = s.Log.WithField("serial", s.SerialNumber)
 
 	s.DeviceType, err = s.magicBox("getDeviceType")
 	if err != nil {
@@ -76,6 +143,16 @@ func (s *AmcrestDevice) GetStorageInfo() (map[string]string, error) {
 	return parsers.ParseManyKV(info, '\n'), nil
 }
 
+// Current JPEG snapshot from the camera
+func (s *AmcrestDevice) Snapshot() ([]byte, error) {
+	stream, err := s.requestStream("/cgi-bin/snapshot.cgi")
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return ioutil.ReadAll(stream)
+}
+
 func (s *AmcrestDevice) magicBox(action string) (string, error) {
 	ret, err := s.request("/cgi-bin/magicBox.cgi?action=" + action)
 	if err != nil {
@@ -85,7 +162,32 @@ func (s *AmcrestDevice) magicBox(action string) (string, error) {
 	return val, nil
 }
 
+// Authenticated request to any endpoint, eg. when reverse engineering new
+// ones. `uri` is relative to the device, eg. "/cgi-bin/magicBox.cgi?action=getSerialNo".
+// Responses are returned whatever their status; the caller closes the body.
+// There's no timeout besides `ctx`, so streams can be held open
+func (s *AmcrestDevice) Do(ctx context.Context, method, uri string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url+uri, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	s.Log.Debugf("Request %s %s", req.Method, req.URL)
+	return s.rawClient.Do(req)
+}
+
 func (s *AmcrestDevice) requestStream(uri string) (io.ReadCloser, error) {
+	resp, err := s.requestResponse(uri)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *AmcrestDevice) requestResponse(uri string) (*http.Response, error) {
 	fullUrl := s.url + uri
 
 	req, err := http.NewRequest(http.MethodGet, fullUrl, nil)
@@ -93,21 +195,21 @@ func (s *AmcrestDevice) requestStream(uri string) (io.ReadCloser, error) {
 		return nil, err
 	}
 
-	logrus.Debugf("Request %s %s", req.Method, req.URL)
+	s.Log.Debugf("Request %s %s", req.Method, req.URL)
 
 	resp, err := s.digestClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	logrus.Tracef("Request to %s returns %d", req.URL, resp.StatusCode)
+	s.Log.Tracef("Request to %s returns %d", req.URL, resp.StatusCode)
 
 	if resp.StatusCode != 200 {
 		resp.Body.Close()
-		return nil, fmt.Errorf("http error %d", resp.StatusCode)
+		return nil, &xhttp.StatusError{StatusCode: resp.StatusCode}
 	}
 
-	return resp.Body, nil
+	return resp, nil
 }
 
 func (s *AmcrestDevice) request(uri string) (string, error) {
@@ -0,0 +1,392 @@
+package amcrest
+
+import (
+	"bytes"
+	"context"
+	"ha-adapters/pkg/amcrest/amcresttest"
+	"ha-adapters/pkg/metrics"
+	"ha-adapters/pkg/xhttp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connectTest(t *testing.T) (*amcresttest.Server, *AmcrestDevice) {
+	srv := amcresttest.NewServer()
+	t.Cleanup(srv.Close)
+
+	device, err := ConnectAmcrest(srv.URL, srv.Username, srv.Password)
+	require.NoError(t, err)
+	return srv, device
+}
+
+func TestConnect(t *testing.T) {
+	_, device := connectTest(t)
+	assert.Equal(t, "AD410TEST0001", device.SerialNumber)
+	assert.Equal(t, "AD410", device.DeviceType)
+	assert.Equal(t, "AD410TEST0001", device.Log.Data["serial"])
+	assert.Equal(t, "amcrest", device.Log.Data["component"])
+	assert.Contains(t, device.SoftwareVersion, "1.000")
+}
+
+func TestConnectBadPassword(t *testing.T) {
+	srv := amcresttest.NewServer()
+	defer srv.Close()
+
+	_, err := ConnectAmcrest(srv.URL, srv.Username, "wrong")
+	assert.Error(t, err)
+}
+
+func TestConnectWrongDevice(t *testing.T) {
+	srv := amcresttest.NewServer()
+	defer srv.Close()
+	srv.SetDevice("X", "IPC-HDW", "1.0")
+
+	_, err := ConnectAmcrest(srv.URL, srv.Username, srv.Password)
+	assert.EqualError(t, err, "expecting ad410")
+}
+
+func TestDo(t *testing.T) {
+	srv := amcresttest.NewServer()
+	defer srv.Close()
+	device := NewAmcrest(srv.URL, srv.Username, srv.Password)
+	assert.Empty(t, srv.Requests())
+
+	resp, err := device.Do(context.Background(), http.MethodGet, "/cgi-bin/magicBox.cgi?action=getSerialNo", nil, "")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "sn=AD410TEST0001\r\n", string(body))
+
+	// Errors are the caller's to look at
+	resp, err = device.Do(context.Background(), http.MethodGet, "/cgi-bin/magicBox.cgi?action=nope", nil, "")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Bodies survive the digest round trip
+	resp, err = device.Do(context.Background(), http.MethodPost, "/cgi-bin/configManager.cgi?action=setConfig&a=b", strings.NewReader("x=y"), "application/x-www-form-urlencoded")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "b", srv.Config("a"))
+}
+
+func TestConfig(t *testing.T) {
+	srv, device := connectTest(t)
+
+	require.NoError(t, device.SetLight(true))
+	assert.Equal(t, "ForceOn", srv.Config("Lighting_V2[0][0][1].Mode"))
+
+	config, err := device.GetConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "On", config["Lighting_V2[0][0][1].State"])
+}
+
+func TestIVSRules(t *testing.T) {
+	srv, device := connectTest(t)
+	srv.SetConfig("VideoAnalyseRule[0][1].Name", "Driveway")
+	srv.SetConfig("VideoAnalyseRule[0][1].Type", "CrossRegionDetection")
+	srv.SetConfig("VideoAnalyseRule[0][1].Enable", "true")
+	srv.SetConfig("VideoAnalyseRule[0][0].Name", "Porch")
+	srv.SetConfig("VideoAnalyseRule[0][0].Enable", "false")
+
+	rules, err := device.GetIVSRules()
+	require.NoError(t, err)
+	assert.Equal(t, []IVSRule{
+		{Channel: 0, Index: 0, Name: "Porch"},
+		{Channel: 0, Index: 1, Name: "Driveway", Type: "CrossRegionDetection", Enable: true},
+	}, rules)
+}
+
+func TestStorageAndSnapshot(t *testing.T) {
+	srv, device := connectTest(t)
+	srv.SetStorage(1000, 250)
+
+	info, err := device.GetStorageInfo()
+	require.NoError(t, err)
+	assert.Equal(t, "1000", info["list.info[0].Detail[0].TotalBytes"])
+	assert.Equal(t, "250", info["list.info[0].Detail[0].UsedBytes"])
+
+	srv.SetSnapshot([]byte("jpeg"))
+	snap, err := device.Snapshot()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("jpeg"), snap)
+}
+
+func TestEventStreamAttach(t *testing.T) {
+	srv, device := connectTest(t)
+
+	stream, err := device.OpenEventStream()
+	require.NoError(t, err)
+	require.True(t, srv.WaitForStreams(1, time.Second))
+	assert.Equal(t, []string{"action=attach&codes=[All]&heartbeat=10"}, srv.Streams())
+
+	srv.DropStreams()
+	_, ok := <-stream
+	assert.False(t, ok)
+}
+
+func TestEventStream(t *testing.T) {
+	srv, device := connectTest(t)
+	var capture bytes.Buffer
+	device.EventCapture = NewCaptureWriter(&capture)
+
+	stream, err := device.OpenEventStream()
+	require.NoError(t, err)
+	require.True(t, srv.WaitForStreams(1, time.Second))
+
+	srv.Emit(amcresttest.Event{Code: "VideoMotion", Action: "Start"})
+	srv.EmitRaw("Heartbeat")
+	srv.EmitRaw("nonsense")
+	srv.Emit(amcresttest.Event{Code: "CrossRegionDetection", Action: "Start", Data: `{"Object": {"ObjectType": "Human"}, "Name": "a;b"}`})
+
+	e := <-stream
+	assert.Equal(t, "VideoMotion", e.Code)
+	assert.Equal(t, "Start", e.Action)
+
+	e = <-stream
+	assert.True(t, IsMalformedPart(e.Err))
+
+	e = <-stream
+	assert.Equal(t, "CrossRegionDetection", e.Code)
+	assert.Equal(t, `{"Object": {"ObjectType": "Human"}, "Name": "a;b"}`, e.Data)
+
+	srv.DropStreams()
+	_, ok := <-stream
+	assert.False(t, ok)
+
+	// Everything raw is captured, including heartbeats
+	assert.Equal(t, 4, strings.Count(capture.String(), "\n"))
+}
+
+func TestEventStreamLost(t *testing.T) {
+	srv, device := connectTest(t)
+
+	stream, err := device.OpenEventStream()
+	require.NoError(t, err)
+	require.True(t, srv.WaitForStreams(1, time.Second))
+
+	srv.AbortStreams()
+	e := <-stream
+	assert.ErrorIs(t, e.Err, ErrStreamLost)
+	_, ok := <-stream
+	assert.False(t, ok)
+}
+
+func TestEventStreamRejected(t *testing.T) {
+	srv, device := connectTest(t)
+
+	srv.RejectStreams(http.StatusServiceUnavailable)
+	_, err := device.OpenEventStream()
+	var status *xhttp.StatusError
+	require.ErrorAs(t, err, &status)
+	assert.Equal(t, http.StatusServiceUnavailable, status.StatusCode)
+
+	// A 200, but not a stream
+	srv.RejectStreams(http.StatusOK)
+	_, err = device.OpenEventStream()
+	assert.ErrorContains(t, err, "expected a multipart stream")
+}
+
+func TestEventStreamCodes(t *testing.T) {
+	srv, device := connectTest(t)
+	device.EventCodes = []string{"VideoMotion", "NewFile"}
+
+	stream, err := device.OpenEventStream()
+	require.NoError(t, err)
+	require.True(t, srv.WaitForStreams(1, time.Second))
+	assert.Equal(t, []string{"action=attach&codes=[VideoMotion,NewFile]&heartbeat=10"}, srv.Streams())
+
+	srv.Emit(amcresttest.Event{Code: "CrossRegionDetection"}, amcresttest.Event{Code: "NewFile"})
+	assert.Equal(t, "NewFile", (<-stream).Code)
+	srv.DropStreams()
+}
+
+func TestEventStreamHeartbeat(t *testing.T) {
+	srv, device := connectTest(t)
+	device.EventHeartbeat = time.Second
+
+	stream, err := device.OpenEventStream()
+	require.NoError(t, err)
+	require.True(t, srv.WaitForStreams(1, time.Second))
+
+	// Heartbeats keep a quiet stream alive past the window
+	time.Sleep(2500 * time.Millisecond)
+	srv.Emit(amcresttest.Event{Code: "VideoMotion", Action: "Start"})
+	assert.Equal(t, "VideoMotion", (<-stream).Code)
+
+	// Half-open; nothing arrives
+	srv.StallStreams(true)
+	select {
+	case e := <-stream:
+		assert.ErrorIs(t, e.Err, ErrHeartbeatTimeout)
+	case <-time.After(4 * time.Second):
+		t.Fatal("stream never timed out")
+	}
+	_, ok := <-stream
+	assert.False(t, ok)
+}
+
+func TestEventStreamEmitBurst(t *testing.T) {
+	srv, device := connectTest(t)
+
+	stream, err := device.OpenEventStream()
+	require.NoError(t, err)
+	require.True(t, srv.WaitForStreams(1, time.Second))
+
+	// More than the fake buffers, while its handler is checking for stalls
+	srv.StallStreams(true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			srv.Emit(amcresttest.Event{Code: "VideoMotion", Action: "Start"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("emitting deadlocked")
+	}
+
+	// Whatever was still buffered comes through first
+	srv.StallStreams(false)
+	srv.Emit(amcresttest.Event{Code: "NewFile"})
+	for e := range stream {
+		if e.Code == "NewFile" {
+			break
+		}
+		assert.Equal(t, "VideoMotion", e.Code)
+	}
+	srv.DropStreams()
+}
+
+func TestReliableEventStream(t *testing.T) {
+	srv, device := connectTest(t)
+	device.StreamBackoff = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	var states []StreamStatus
+	var errs []error
+	device.OnStreamStatus = func(state StreamState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state.Status)
+		errs = append(errs, state.Err)
+	}
+
+	stream := device.OpenReliableEventStream(2)
+	require.True(t, srv.WaitForStreams(1, time.Second))
+
+	// Reconnects when cut off
+	srv.AbortStreams()
+	require.True(t, srv.WaitForStreams(1, time.Second))
+	srv.Emit(amcresttest.Event{Code: "VideoMotion", Action: "Start"})
+	assert.Equal(t, "VideoMotion", (<-stream).Code)
+
+	// Gives up once the device is gone
+	srv.Close()
+	e := <-stream
+	assert.ErrorContains(t, e.Err, "giving up after 2 attempts")
+	_, ok := <-stream
+	assert.False(t, ok)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []StreamStatus{
+		STREAM_CONNECTING, STREAM_CONNECTED, STREAM_DISCONNECTED,
+		STREAM_CONNECTING, STREAM_CONNECTED, STREAM_DISCONNECTED,
+		STREAM_CONNECTING, STREAM_DISCONNECTED,
+		STREAM_CONNECTING, STREAM_DISCONNECTED,
+	}, states)
+	// Says why
+	assert.ErrorIs(t, errs[2], ErrStreamLost)
+}
+
+func TestDownloadMetrics(t *testing.T) {
+	srv, device := connectTest(t)
+	dir := t.TempDir()
+	for _, name := range []string{"metrics-a.jpg", "metrics-b.jpg"} {
+		srv.SetFile("/mnt/sd/"+name, []byte("jpeg"))
+		_, err := device.DownloadFileTo("/mnt/sd/"+name, filepath.Join(dir, name))
+		require.NoError(t, err)
+	}
+
+	// One series for every file, not one each
+	var buf bytes.Buffer
+	require.NoError(t, metrics.Default.Write(&buf))
+	assert.NotContains(t, buf.String(), "metrics-a.jpg")
+	series := 0
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, `http_client_requests_total{client="amcrest",method="GET",endpoint="/cgi-bin/RPC_Loadfile",status="200"}`) {
+			series++
+		}
+	}
+	assert.Equal(t, 1, series)
+}
+
+func TestCGIEndpoint(t *testing.T) {
+	for path, endpoint := range map[string]string{
+		"/cgi-bin/magicBox.cgi":                "/cgi-bin/magicBox.cgi",
+		"/cgi-bin/RPC_Loadfile/mnt/sd/a/b.jpg": "/cgi-bin/RPC_Loadfile",
+		"/cgi-bin/RPC_Loadfile":                "/cgi-bin/RPC_Loadfile",
+		"/":                                    "other",
+		"/web/anything/at/all":                 "other",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path+"?action=x", nil)
+		assert.Equal(t, endpoint, cgiEndpoint(req), path)
+	}
+}
+
+func TestDownloads(t *testing.T) {
+	srv, device := connectTest(t)
+	device.ClipPollInterval = 10 * time.Millisecond
+
+	camJpg := "/mnt/sd/2023-01-20/001/jpg/10/56/56[M][0@0][0].jpg"
+	camClip := "/mnt/sd/2023-01-20/001/dav/10/10.56.56-10.57.44[M][0@0][0].mp4"
+	srv.SetFile(camJpg, []byte("jpeg"))
+	srv.SetFile(camClip, []byte("not dav, kept as-is"))
+
+	dir := t.TempDir()
+	downloader := device.NewDownloader(2, 2)
+	downloader.Backoff = time.Millisecond
+
+	require.NoError(t, downloader.Enqueue(DownloadJob{Path: camJpg, To: filepath.Join(dir, "a", "snap.jpg")}))
+	require.NoError(t, downloader.Enqueue(DownloadJob{Path: camClip, To: filepath.Join(dir, "clip.mp4"), Clip: true}))
+	require.NoError(t, downloader.Enqueue(DownloadJob{Path: "/mnt/sd/missing.jpg", To: filepath.Join(dir, "missing.jpg")}))
+
+	results := make(map[string]DownloadResult)
+	for i := 0; i < 3; i++ {
+		r := <-downloader.Results()
+		results[r.Path] = r
+	}
+	downloader.Close()
+
+	assert.NoError(t, results[camJpg].Err)
+	assert.Equal(t, int64(4), results[camJpg].Bytes)
+	data, _ := os.ReadFile(filepath.Join(dir, "a", "snap.jpg"))
+	assert.Equal(t, "jpeg", string(data))
+
+	assert.NoError(t, results[camClip].Err)
+	data, _ = os.ReadFile(filepath.Join(dir, "clip.mp4"))
+	assert.Equal(t, "not dav, kept as-is", string(data))
+
+	missing := results["/mnt/sd/missing.jpg"]
+	assert.True(t, xhttp.IsClientError(missing.Err), "404, not retried")
+	assert.Equal(t, 1, missing.Attempts)
+	assert.NoFileExists(t, filepath.Join(dir, "missing.jpg"))
+
+	// No temp files left behind
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 2)
+}
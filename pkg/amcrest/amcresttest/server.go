@@ -0,0 +1,495 @@
+package amcresttest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"ha-adapters/pkg/parsers"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A fake Amcrest/Dahua doorbell serving enough of the HTTP API to exercise
+`pkg/amcrest` (and adapters built on it) offline. Every request requires
+digest auth, just like the real device
+*/
+
+const Boundary = "myboundary"
+
+type Event struct {
+	Code   string
+	Action string
+	Index  int
+	Data   string // JSON, optional
+}
+
+func (s Event) Payload() string {
+	payload := fmt.Sprintf("Code=%s;action=%s;index=%d", s.Code, s.Action, s.Index)
+	if s.Data != "" {
+		payload += ";data=" + s.Data
+	}
+	return payload
+}
+
+type Server struct {
+	*httptest.Server
+
+	Username, Password string
+	Realm              string
+	nonce              string
+
+	mu              sync.Mutex
+	serialNumber    string
+	deviceType      string
+	softwareVersion string
+	config          map[string]string
+	storage         map[string]string
+	files           map[string][]byte
+	snapshot        []byte
+	streams         map[*stream]struct{}
+	requests        []string
+	streamChanged   chan struct{}
+	stalled         bool
+	rejectStreams   int // Status to answer attaches with, if set
+	done            chan struct{}
+	closeOnce       sync.Once
+}
+
+type stream struct {
+	query  string
+	codes  map[string]bool // nil for All
+	parts  chan string
+	cancel chan struct{} // Dropped by the test
+	abort  bool          // Cut the connection, rather than ending the response
+	closed chan struct{} // Handler has returned
+}
+
+func (s *stream) wants(code string) bool {
+	return s.codes == nil || s.codes[code]
+}
+
+func NewServer() *Server {
+	s := &Server{
+		Username:        "admin",
+		Password:        "password",
+		Realm:           "Login to AD410TEST0001",
+		nonce:           strconv.FormatInt(time.Now().UnixNano(), 16),
+		serialNumber:    "AD410TEST0001",
+		deviceType:      "AD410",
+		softwareVersion: "1.000.0000000.7.R,build:2022-08-08",
+		config: map[string]string{
+			"Lighting_V2[0][0][1].Mode":  "Auto",
+			"Lighting_V2[0][0][1].State": "Flicker",
+		},
+		storage:       make(map[string]string),
+		files:         make(map[string][]byte),
+		snapshot:      []byte("\xff\xd8\xff\xe0fake jpeg\xff\xd9"),
+		streams:       make(map[*stream]struct{}),
+		streamChanged: make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	s.SetStorage(32*1024*1024*1024, 8*1024*1024*1024)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/magicBox.cgi", s.handleMagicBox)
+	mux.HandleFunc("/cgi-bin/configManager.cgi", s.handleConfig)
+	mux.HandleFunc("/cgi-bin/storageDevice.cgi", s.handleStorage)
+	mux.HandleFunc("/cgi-bin/snapshot.cgi", s.handleSnapshot)
+	mux.HandleFunc("/cgi-bin/eventManager.cgi", s.handleEvents)
+	mux.HandleFunc("/cgi-bin/RPC_Loadfile/", s.handleLoadfile)
+
+	s.Server = httptest.NewServer(s.withDigest(mux))
+	return s
+}
+
+// Safe to call more than once, eg. to simulate the device going away mid-test
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.Server.Close()
+	})
+}
+
+// Device identity, as reported by magicBox
+func (s *Server) SetDevice(serial, deviceType, version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serialNumber, s.deviceType, s.softwareVersion = serial, deviceType, version
+}
+
+func (s *Server) Config(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config[key]
+}
+
+func (s *Server) SetConfig(key, val string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config[key] = val
+}
+
+func (s *Server) SetStorage(totalBytes, usedBytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.storage["list.info[0].Detail[0].TotalBytes"] = strconv.FormatInt(totalBytes, 10)
+	s.storage["list.info[0].Detail[0].UsedBytes"] = strconv.FormatInt(usedBytes, 10)
+	s.storage["list.info[0].State"] = "Success"
+}
+
+// Serve `data` from RPC_Loadfile at `path` (eg. the `File` of a `NewFile` event)
+func (s *Server) SetFile(path string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = data
+}
+
+func (s *Server) SetSnapshot(jpeg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshot = jpeg
+}
+
+// Request URIs received (authenticated only), in order
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Query strings of currently attached event streams
+func (s *Server) Streams() (ret []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for st := range s.streams {
+		ret = append(ret, st.query)
+	}
+	sort.Strings(ret)
+	return
+}
+
+// Block until `n` event streams are attached
+func (s *Server) WaitForStreams(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		count := len(s.streams)
+		s.mu.Unlock()
+		if count >= n {
+			return true
+		}
+		select {
+		case <-s.streamChanged:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// Send an event to every attached stream that asked for its code
+func (s *Server) Emit(events ...Event) {
+	for _, e := range events {
+		for _, st := range s.attached() {
+			if st.wants(e.Code) {
+				s.send(st, e.Payload())
+			}
+		}
+	}
+}
+
+// Send a raw part payload to every attached stream
+func (s *Server) EmitRaw(payload string) {
+	for _, st := range s.attached() {
+		s.send(st, payload)
+	}
+}
+
+func (s *Server) attached() []*stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]*stream, 0, len(s.streams))
+	for st := range s.streams {
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+// Without holding the lock, as the stream's handler needs it to write. Gives
+// up if the stream goes away meanwhile
+func (s *Server) send(st *stream, payload string) {
+	select {
+	case st.parts <- payload:
+	case <-st.cancel:
+	case <-st.closed:
+	case <-s.done:
+	}
+}
+
+// Disconnect every attached event stream, as if the device dropped them
+func (s *Server) DropStreams() {
+	s.dropStreams(false)
+}
+
+// Cut every attached event stream's connection mid-response, as if the
+// network failed
+func (s *Server) AbortStreams() {
+	s.dropStreams(true)
+}
+
+func (s *Server) dropStreams(abort bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for st := range s.streams {
+		st.abort = abort
+		close(st.cancel)
+		delete(s.streams, st)
+	}
+}
+
+// Stop writing anything, heartbeats included, to attached streams while
+// keeping them open; like a half-open connection
+func (s *Server) StallStreams(stalled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stalled = stalled
+}
+
+// Answer new attaches with a plain `status` response instead of a stream; 0
+// goes back to streaming
+func (s *Server) RejectStreams(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejectStreams = status
+}
+
+func (s *Server) isStalled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stalled
+}
+
+func (s *Server) withDigest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkDigest(r) {
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Digest realm="%s", qop="auth", nonce="%s", opaque="%s"`, s.Realm, s.nonce, md5Hex(s.Realm)))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		s.mu.Lock()
+		s.requests = append(s.requests, r.URL.RequestURI())
+		s.mu.Unlock()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) checkDigest(r *http.Request) bool {
+	const prefix = "Digest "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	fields := parsers.ParseManyKV(header[len(prefix):], ',')
+
+	if fields["username"] != s.Username || fields["nonce"] != s.nonce || fields["uri"] != r.URL.RequestURI() {
+		return false
+	}
+
+	ha1 := md5Hex(s.Username + ":" + s.Realm + ":" + s.Password)
+	ha2 := md5Hex(r.Method + ":" + fields["uri"])
+	expected := md5Hex(strings.Join([]string{ha1, fields["nonce"], fields["nc"], fields["cnonce"], fields["qop"], ha2}, ":"))
+	return fields["response"] == expected
+}
+
+func (s *Server) handleMagicBox(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.URL.Query().Get("action") {
+	case "getSerialNo":
+		fmt.Fprintf(w, "sn=%s\r\n", s.serialNumber)
+	case "getDeviceType":
+		fmt.Fprintf(w, "type=%s\r\n", s.deviceType)
+	case "getSoftwareVersion":
+		fmt.Fprintf(w, "version=%s\r\n", s.softwareVersion)
+	default:
+		http.Error(w, "Error\r\nBad Request!", http.StatusBadRequest)
+	}
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := r.URL.Query()
+	switch q.Get("action") {
+	case "getConfig":
+		name := q.Get("name")
+		keys := make([]string, 0, len(s.config))
+		for k := range s.config {
+			if name == "All" || strings.HasPrefix(k, name) {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			http.Error(w, "Error\r\nBad Request!", http.StatusBadRequest)
+			return
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			// Only "All" gets its name in the key
+			if name == "All" {
+				fmt.Fprintf(w, "table.All.%s=%s\r\n", k, s.config[k])
+			} else {
+				fmt.Fprintf(w, "table.%s=%s\r\n", k, s.config[k])
+			}
+		}
+	case "setConfig":
+		for k, v := range q {
+			if k != "action" && len(v) > 0 {
+				s.config[k] = v[0]
+			}
+		}
+		fmt.Fprint(w, "OK\r\n")
+	default:
+		http.Error(w, "Error\r\nBad Request!", http.StatusBadRequest)
+	}
+}
+
+func (s *Server) handleStorage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.storage))
+	for k := range s.storage {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s=%s\r\n", k, s.storage[k])
+	}
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	snapshot := s.snapshot
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(snapshot)))
+	w.Write(snapshot)
+}
+
+func (s *Server) handleLoadfile(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/cgi-bin/RPC_Loadfile")
+
+	s.mu.Lock()
+	data, ok := s.files[path]
+	s.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("action") != "attach" {
+		http.Error(w, "Error\r\nBad Request!", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	reject := s.rejectStreams
+	s.mu.Unlock()
+	if reject != 0 {
+		http.Error(w, "Error\r\nNot Available!", reject)
+		return
+	}
+
+	st := &stream{
+		query:  r.URL.RawQuery,
+		parts:  make(chan string, 100),
+		cancel: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	codes := strings.Trim(r.URL.Query().Get("codes"), "[]")
+	if codes != "All" {
+		st.codes = make(map[string]bool)
+		for _, code := range strings.Split(codes, ",") {
+			st.codes[code] = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+Boundary)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	s.mu.Lock()
+	s.streams[st] = struct{}{}
+	s.mu.Unlock()
+	select {
+	case s.streamChanged <- struct{}{}:
+	default:
+	}
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.streams, st)
+		s.mu.Unlock()
+		close(st.closed)
+	}()
+
+	writePart := func(payload string) {
+		if s.isStalled() {
+			return
+		}
+		fmt.Fprintf(w, "--%s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s\r\n", Boundary, len(payload), payload)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	// Device sends "Heartbeat" parts every `heartbeat` seconds, if asked
+	var heartbeat <-chan time.Time
+	if secs, _ := strconv.Atoi(r.URL.Query().Get("heartbeat")); secs > 0 {
+		ticker := time.NewTicker(time.Duration(secs) * time.Second)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		select {
+		case payload := <-st.parts:
+			writePart(payload)
+		case <-heartbeat:
+			writePart("Heartbeat")
+		case <-st.cancel:
+			if st.abort {
+				panic(http.ErrAbortHandler)
+			}
+			return
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func md5Hex(text string) string {
+	hash := md5.Sum([]byte(text))
+	return hex.EncodeToString(hash[:])
+}
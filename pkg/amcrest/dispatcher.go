@@ -0,0 +1,105 @@
+package amcrest
+
+import (
+	"ha-adapters/pkg/xlog"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Handles any event code
+const DISPATCH_ALL = "*"
+
+// Fans events out to handlers by code. Each handler gets its own buffered queue
+// and goroutine, so a slow handler only backs up (and then drops) its own events
+type Dispatcher struct {
+	routes []*route
+	wg     sync.WaitGroup
+
+	// Called with stream errors, eg. malformed parts
+	OnError func(error)
+
+	Log *logrus.Entry
+}
+
+type route struct {
+	code    string
+	events  chan Event
+	fn      func(Event)
+	dropped int
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{Log: xlog.Component("amcrest")}
+}
+
+// Register `fn` for `code` (or DISPATCH_ALL), queueing up to `buffer` events.
+// Must be called before `Run`
+func (s *Dispatcher) Handle(code string, buffer int, fn func(Event)) {
+	s.routes = append(s.routes, &route{
+		code:   code,
+		events: make(chan Event, buffer),
+		fn:     fn,
+	})
+}
+
+// Codes with a handler, to filter the stream by. nil if anything handles all codes
+func (s *Dispatcher) Codes() []string {
+	seen := make(map[string]struct{})
+	for _, r := range s.routes {
+		if r.code == DISPATCH_ALL {
+			return nil
+		}
+		seen[r.code] = struct{}{}
+	}
+
+	codes := make([]string, 0, len(seen))
+	for code := range seen {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Dispatch until `events` closes, then wait for handlers to drain
+func (s *Dispatcher) Run(events <-chan Event) {
+	s.wg.Add(len(s.routes))
+	for _, r := range s.routes {
+		go func(r *route) {
+			defer s.wg.Done()
+			for event := range r.events {
+				r.fn(event)
+			}
+		}(r)
+	}
+
+	for event := range events {
+		if event.Err != nil {
+			metricEventErrors.With().Inc()
+			if s.OnError != nil {
+				s.OnError(event.Err)
+			}
+			continue
+		}
+		metricEvents.With(event.Code, event.Action).Inc()
+
+		for _, r := range s.routes {
+			if r.code != DISPATCH_ALL && r.code != event.Code {
+				continue
+			}
+			select {
+			case r.events <- event:
+			default:
+				r.dropped++
+				metricEventsDropped.With(event.Code).Inc()
+				s.Log.WithField("code", event.Code).Warnf("Handler for %s is backed up, dropped event (%d total)", r.code, r.dropped)
+			}
+		}
+	}
+
+	for _, r := range s.routes {
+		close(r.events)
+	}
+	s.wg.Wait()
+}
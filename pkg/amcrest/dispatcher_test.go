@@ -0,0 +1,79 @@
+package amcrest
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcherCodes(t *testing.T) {
+	d := NewDispatcher()
+	d.Handle("VideoMotion", 1, func(Event) {})
+	d.Handle("NewFile", 1, func(Event) {})
+	d.Handle("VideoMotion", 1, func(Event) {})
+	assert.Equal(t, []string{"NewFile", "VideoMotion"}, d.Codes())
+
+	d.Handle(DISPATCH_ALL, 1, func(Event) {})
+	assert.Nil(t, d.Codes())
+}
+
+func TestDispatcherSlowHandler(t *testing.T) {
+	d := NewDispatcher()
+
+	var mu sync.Mutex
+	var motion, all []string
+	var errs []error
+	d.Handle("VideoMotion", 10, func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		motion = append(motion, e.Action)
+	})
+	d.Handle(DISPATCH_ALL, 10, func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		all = append(all, e.Code)
+	})
+
+	unblock := make(chan struct{})
+	slow := 0
+	d.Handle("NewFile", 1, func(e Event) {
+		<-unblock
+		slow++
+	})
+	d.OnError = func(err error) { errs = append(errs, err) }
+
+	events := make(chan Event, 10)
+	// Handler blocks; at most one is in flight and one buffered, the rest drop
+	events <- Event{Code: "NewFile"}
+	events <- Event{Code: "NewFile"}
+	events <- Event{Code: "NewFile"}
+	events <- Event{Code: "VideoMotion", Action: "Start"}
+	events <- Event{Err: errors.New("bad part")}
+	events <- Event{Code: "VideoMotion", Action: "Stop"}
+	close(events)
+
+	done := make(chan struct{})
+	go func() {
+		d.Run(events)
+		close(done)
+	}()
+
+	// Motion isn't held up by the slow handler
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(motion) == 2
+	}, time.Second, time.Millisecond)
+
+	close(unblock)
+	<-done
+
+	assert.Equal(t, []string{"Start", "Stop"}, motion)
+	assert.Len(t, all, 5)
+	assert.GreaterOrEqual(t, slow, 1)
+	assert.Less(t, slow, 3)
+	assert.Len(t, errs, 1)
+}
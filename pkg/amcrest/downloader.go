@@ -0,0 +1,146 @@
+package amcrest
+
+import (
+	"errors"
+	"ha-adapters/pkg/dav"
+	"ha-adapters/pkg/xhttp"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("download queue full")
+
+type DownloadJob struct {
+	Path string // Path on the device, from `NewFile`
+	To   string // Local destination
+	Clip bool   // Wait for the recording to finish, and remux to mp4
+}
+
+type DownloadResult struct {
+	DownloadJob
+	Bytes    int64
+	Attempts int
+	Err      error
+}
+
+// Downloader runs downloads on a bounded pool of workers, retrying failures
+// with exponential backoff; except ones that can't succeed, like a 404 or a
+// corrupt clip. Every job produces exactly one result until closed
+type Downloader struct {
+	device  *AmcrestDevice
+	jobs    chan DownloadJob
+	results chan DownloadResult
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	MaxAttempts int
+	Backoff     time.Duration // Delay before first retry, doubling each attempt
+	MaxBackoff  time.Duration
+}
+
+func (s *AmcrestDevice) NewDownloader(workers, maxAttempts int) *Downloader {
+	d := &Downloader{
+		device:      s,
+		jobs:        make(chan DownloadJob, 100),
+		results:     make(chan DownloadResult, 100),
+		stop:        make(chan struct{}),
+		MaxAttempts: maxAttempts,
+		Backoff:     2 * time.Second,
+		MaxBackoff:  1 * time.Minute,
+	}
+
+	d.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.worker()
+	}
+
+	return d
+}
+
+// Queue a job without blocking. Returns ErrQueueFull if the workers are backed up
+func (s *Downloader) Enqueue(job DownloadJob) error {
+	select {
+	case s.jobs <- job:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (s *Downloader) Results() <-chan DownloadResult {
+	return s.results
+}
+
+// Stop accepting jobs, wait for in-flight downloads to finish, and close `Results()`.
+// Queued jobs that haven't started are dropped
+func (s *Downloader) Close() {
+	close(s.stop)
+	close(s.jobs)
+	s.wg.Wait()
+	close(s.results)
+}
+
+func (s *Downloader) worker() {
+	defer s.wg.Done()
+	for job := range s.jobs {
+		if s.stopping() {
+			continue
+		}
+		result := s.run(job)
+		select {
+		case s.results <- result:
+		case <-s.stop:
+		}
+	}
+}
+
+func (s *Downloader) stopping() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Downloader) run(job DownloadJob) (ret DownloadResult) {
+	ret.DownloadJob = job
+
+	backoff := s.Backoff
+	for ret.Attempts < s.MaxAttempts || ret.Attempts == 0 {
+		if ret.Attempts > 0 {
+			s.device.Log.WithField("path", job.Path).Infof("Retrying download in %s: %v", backoff, ret.Err)
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+				return
+			}
+			backoff *= 2
+			if backoff > s.MaxBackoff {
+				backoff = s.MaxBackoff
+			}
+		}
+		ret.Attempts++
+
+		if job.Clip {
+			ret.Bytes, ret.Err = s.device.DownloadClipTo(job.Path, job.To)
+		} else {
+			ret.Bytes, ret.Err = s.device.DownloadFileTo(job.Path, job.To)
+		}
+		if ret.Err == nil || isPermanent(ret.Err) {
+			return
+		}
+	}
+	return
+}
+
+// Failures that would fail the same way again
+func isPermanent(err error) bool {
+	return xhttp.IsClientError(err) ||
+		errors.Is(err, ErrUnknownLength) ||
+		// The clip itself is the problem
+		errors.Is(err, dav.ErrUnsupportedCodec) ||
+		errors.Is(err, dav.ErrNoVideo) ||
+		errors.Is(err, dav.ErrBadFrame) ||
+		errors.Is(err, dav.ErrMissingParameterSets)
+}
@@ -0,0 +1,165 @@
+package amcrest
+
+import (
+	"errors"
+	"fmt"
+	"ha-adapters/pkg/dav"
+	"ha-adapters/pkg/xhttp"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Just enough of a device to connect to and download `files` from. The first
+// `failures` downloads of each file fail with a 503
+func downloadTest(t *testing.T, files map[string]string, failures int) *AmcrestDevice {
+	var mu sync.Mutex
+	failed := make(map[string]int)
+	nonce := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Each nonce is good for one request, so retries are challenged again
+		mu.Lock()
+		current := fmt.Sprintf(`nonce="%d"`, nonce)
+		authorized := strings.Contains(r.Header.Get("Authorization"), current)
+		nonce++
+		next := nonce
+		mu.Unlock()
+		if !authorized {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="test", qop="auth", nonce="%d"`, next))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Query().Get("action") {
+		case "getSerialNo":
+			w.Write([]byte("sn=SN1\r\n"))
+			return
+		case "getDeviceType":
+			w.Write([]byte("type=AD410\r\n"))
+			return
+		case "getSoftwareVersion":
+			w.Write([]byte("version=1.0\r\n"))
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/cgi-bin/RPC_Loadfile")
+		data, ok := files[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		fail := failed[path] < failures
+		failed[path]++
+		mu.Unlock()
+		if fail {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	t.Cleanup(srv.Close)
+
+	device, err := ConnectAmcrest(srv.URL, "admin", "password")
+	require.NoError(t, err)
+	return device
+}
+
+func TestDownloaderRetry(t *testing.T) {
+	// Enough to exhaust the client's own retries once
+	device := downloadTest(t, map[string]string{"/mnt/sd/a.jpg": "jpeg"}, 5)
+	downloader := device.NewDownloader(1, 3)
+	downloader.Backoff = time.Millisecond
+	defer downloader.Close()
+
+	dir := t.TempDir()
+	to := filepath.Join(dir, "a.jpg")
+	require.NoError(t, downloader.Enqueue(DownloadJob{Path: "/mnt/sd/a.jpg", To: to}))
+	result := <-downloader.Results()
+	require.NoError(t, result.Err)
+	assert.Equal(t, 2, result.Attempts)
+	assert.Equal(t, int64(4), result.Bytes)
+
+	data, err := os.ReadFile(to)
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", string(data))
+
+	// No temp files left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestDownloaderGivesUp(t *testing.T) {
+	device := downloadTest(t, map[string]string{"/mnt/sd/a.jpg": "jpeg"}, 1000)
+	downloader := device.NewDownloader(1, 2)
+	downloader.Backoff = time.Millisecond
+	defer downloader.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, downloader.Enqueue(DownloadJob{Path: "/mnt/sd/a.jpg", To: filepath.Join(dir, "a.jpg")}))
+	result := <-downloader.Results()
+	assert.Error(t, result.Err)
+	assert.Equal(t, 2, result.Attempts)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestDownloaderQueueFull(t *testing.T) {
+	device := downloadTest(t, nil, 0)
+	downloader := device.NewDownloader(0, 1) // Nothing takes jobs off the queue
+	defer downloader.Close()
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, downloader.Enqueue(DownloadJob{Path: "/mnt/sd/a.jpg"}))
+	}
+	assert.ErrorIs(t, downloader.Enqueue(DownloadJob{Path: "/mnt/sd/a.jpg"}), ErrQueueFull)
+}
+
+func TestDownloadRetries(t *testing.T) {
+	srv, device := connectTest(t)
+	camClip := "/mnt/sd/2023-01-20/001/dav/10/10.56.56-10.57.44[M][0@0][0].mp4"
+	srv.SetFile(camClip, []byte("still recording"))
+
+	// Never seen to finish in time; worth trying again
+	device.ClipPollInterval = 50 * time.Millisecond
+	device.ClipTimeout = 10 * time.Millisecond
+
+	downloader := device.NewDownloader(1, 3)
+	downloader.Backoff = time.Millisecond
+	defer downloader.Close()
+
+	assert.NoError(t, downloader.Enqueue(DownloadJob{Path: camClip, To: filepath.Join(t.TempDir(), "clip.mp4"), Clip: true}))
+	result := <-downloader.Results()
+	assert.ErrorIs(t, result.Err, ErrFileNotClosed)
+	assert.Equal(t, 3, result.Attempts)
+}
+
+func TestIsPermanent(t *testing.T) {
+	for err, permanent := range map[error]bool{
+		&xhttp.StatusError{StatusCode: 404}:              true,
+		&xhttp.StatusError{StatusCode: 401}:              true,
+		&xhttp.StatusError{StatusCode: 503}:              false,
+		fmt.Errorf("remux: %w", dav.ErrUnsupportedCodec): true,
+		dav.ErrNoVideo: true,
+		fmt.Errorf("%w: bad trailer", dav.ErrBadFrame):     true,
+		dav.ErrMissingParameterSets:                        true,
+		ErrUnknownLength:                                   true,
+		ErrFileNotClosed:                                   false,
+		ErrLengthMismatch:                                  false,
+		errors.New("connection reset"):                     false,
+		fmt.Errorf("wrapped: %w", xhttp.ErrorExceedsRetry): false,
+	} {
+		assert.Equal(t, permanent, isPermanent(err), err.Error())
+	}
+}
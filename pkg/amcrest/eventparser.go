@@ -0,0 +1,218 @@
+package amcrest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrShortPart   = errors.New("part shorter than content-length")
+	ErrMissingCode = errors.New("no event code")
+)
+
+// Sent as an `Event.Err` when a single part can't be understood. The stream
+// carries on afterwards, so these aren't fatal
+type MalformedPartError struct {
+	Payload []byte
+	Err     error
+}
+
+func (s *MalformedPartError) Error() string {
+	if len(s.Payload) > 0 {
+		return fmt.Sprintf("malformed event part (%v): %q", s.Err, s.Payload)
+	}
+	return fmt.Sprintf("malformed event part: %v", s.Err)
+}
+
+func (s *MalformedPartError) Unwrap() error {
+	return s.Err
+}
+
+func IsMalformedPart(err error) bool {
+	var malformed *MalformedPartError
+	return errors.As(err, &malformed)
+}
+
+const (
+	maxPartSize          = 1024 * 1024
+	maxSequentialBadHead = 5 // NextPart errors in a row before giving up on the stream
+)
+
+// Parses the multipart event stream into `c` until it ends. Every raw
+// payload, even ones we can't parse, is recorded to `capture` if set. Returns
+// why it ended, or nil if the device closed it
+func readEventStream(log *logrus.Entry, body io.Reader, boundary string, capture *CaptureWriter, c chan<- Event) error {
+	conn := &errReader{r: body}
+	mp := multipart.NewReader(conn, boundary)
+
+	badHeads := 0
+	for {
+		part, err := mp.NextPart()
+		if err == io.EOF || conn.err == io.EOF {
+			return nil
+		}
+		if conn.err != nil {
+			return conn.err
+		}
+		if err != nil {
+			// A mangled header; the reader skips ahead to the next boundary
+			badHeads++
+			if badHeads >= maxSequentialBadHead {
+				log.Warnf("Giving up on event stream: %v", err)
+				return err
+			}
+			c <- Event{Err: &MalformedPartError{Err: err}}
+			continue
+		}
+		badHeads = 0
+
+		// Closing drains to the next boundary, which may not arrive until the
+		// next event; so deliver before closing
+		data, err := readPart(part)
+		handlePart(log, data, err, capture, c)
+		part.Close()
+	}
+}
+
+// Calls `fn` with each part of any multipart stream as it arrives, until the
+// stream ends or `fn` errors. Unlike the event stream, nothing is parsed
+func ReadMultipart(body io.Reader, boundary string, fn func(header textproto.MIMEHeader, data []byte) error) error {
+	mp := multipart.NewReader(body, boundary)
+	for {
+		part, err := mp.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// As above, deliver before closing
+		data, err := readPart(part)
+		if err != nil {
+			part.Close()
+			return err
+		}
+		err = fn(part.Header, data)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func handlePart(log *logrus.Entry, data []byte, err error, capture *CaptureWriter, c chan<- Event) {
+	log.Tracef("Received %d bytes: %s", len(data), string(data))
+	if capture != nil && len(data) > 0 {
+		if err := capture.Write(data); err != nil {
+			log.Warnf("Error writing event capture: %v", err)
+		}
+	}
+
+	if err != nil {
+		c <- Event{Err: &MalformedPartError{Payload: data, Err: err}}
+		return
+	}
+	if len(data) == 0 || isHeartbeat(data) {
+		log.Trace("Event stream heartbeat")
+		return
+	}
+
+	event := payloadToEvent(data)
+	if event.Err == nil {
+		log.WithFields(logrus.Fields{"code": event.Code, "action": event.Action, "index": event.Index}).Debug("Received event")
+	}
+	c <- event
+}
+
+// Reads a whole part. Content-length is trusted if present, but not required
+func readPart(part *multipart.Part) ([]byte, error) {
+	if datalen, err := strconv.Atoi(part.Header.Get("content-length")); err == nil && datalen >= 0 && datalen <= maxPartSize {
+		data := make([]byte, datalen)
+		n, err := io.ReadFull(part, data)
+		if err == io.ErrUnexpectedEOF || (err == io.EOF && datalen > 0) {
+			return bytes.TrimSpace(data[:n]), ErrShortPart
+		}
+		if err != nil {
+			return data[:n], err
+		}
+		return bytes.TrimSpace(data), nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(part, maxPartSize))
+	return bytes.TrimSpace(data), err
+}
+
+// Remembers the underlying connection's error, which multipart doesn't wrap
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *errReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+func isHeartbeat(payload []byte) bool {
+	return bytes.EqualFold(payload, []byte("Heartbeat"))
+}
+
+func payloadToEvent(payload []byte) (ret Event) {
+	bucket := parseStreamPayload(payload)
+
+	if bucket["code"] == "" {
+		return Event{Err: &MalformedPartError{Payload: payload, Err: ErrMissingCode}}
+	}
+
+	index, _ := strconv.Atoi(bucket["index"])
+	return Event{
+		Code:   bucket["code"],
+		Action: bucket["action"],
+		Index:  index,
+		Data:   bucket["data"],
+	}
+}
+
+// `key=val;key=val;data={...}`. `data` is always last, and may contain `;`
+func parseStreamPayload(payload []byte) (ret map[string]string) {
+	ret = make(map[string]string)
+
+	for len(payload) > 0 {
+		nextToken := bytes.IndexByte(payload, ';')
+		var slice []byte
+		if nextToken < 0 {
+			slice = payload
+		} else {
+			slice = payload[:nextToken]
+		}
+
+		if delimIndex := bytes.IndexByte(slice, '='); delimIndex > 0 {
+			key := strings.ToLower(strings.TrimSpace(string(slice[:delimIndex])))
+			if key == "data" {
+				ret[key] = strings.TrimSpace(string(payload[delimIndex+1:]))
+				break
+			}
+			ret[key] = string(slice[delimIndex+1:])
+		}
+
+		if nextToken < 0 {
+			break
+		}
+
+		payload = payload[len(slice)+1:]
+	}
+
+	return
+}
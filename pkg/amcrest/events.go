@@ -1,16 +1,20 @@
 package amcrest
 
 import (
-	"bytes"
+	"errors"
+	"fmt"
 	"ha-adapters/pkg/xhttp"
+	"io"
 	"mime"
-	"mime/multipart"
 	"net/http"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+)
 
-	"github.com/sirupsen/logrus"
+var (
+	ErrHeartbeatTimeout = errors.New("event stream heartbeat missed")
+	ErrStreamLost       = errors.New("event stream connection lost")
 )
 
 type Event struct {
@@ -20,36 +24,25 @@ type Event struct {
 	Data         string
 }
 
-func (s *AmcrestDevice) OpenReliableEventStream(maxSequentialRetries int) <-chan Event {
-	c := make(chan Event, 10)
-	go func() {
-		defer close(c)
-		for retries := 0; retries < maxSequentialRetries; retries++ {
-			stream, err := s.OpenEventStream()
-			if err != nil {
-				logrus.Warnf("Error opening stream: %v", err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-
-			retries = 0 // reset! Success!
-
-			for event := range stream {
-				c <- event
-			}
-		}
-	}()
-	return c
-}
-
 func (s *AmcrestDevice) OpenEventStream() (<-chan Event, error) {
 	/*
 		Stream is a long-open multipart HTTP stream with a data-like object that
 		needs custom parsing
 	*/
-	logrus.Info("Opening event stream...")
+	s.Log.Info("Opening event stream...")
 
-	url := s.url + "/cgi-bin/eventManager.cgi?action=attach&codes=[All]"
+	codes := "All"
+	if len(s.EventCodes) > 0 {
+		codes = strings.Join(s.EventCodes, ",")
+	}
+	url := s.url + "/cgi-bin/eventManager.cgi?action=attach&codes=[" + codes + "]"
+	heartbeat := s.EventHeartbeat
+	if heartbeat > 0 {
+		if heartbeat < time.Second {
+			heartbeat = time.Second
+		}
+		url += fmt.Sprintf("&heartbeat=%d", int(heartbeat/time.Second))
+	}
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
@@ -61,50 +54,51 @@ func (s *AmcrestDevice) OpenEventStream() (<-chan Event, error) {
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &xhttp.StatusError{StatusCode: resp.StatusCode}
+	}
 
-	// Start read loop
-
-	logrus.Info("Connection open, listening to stream...")
-	c := make(chan Event, 10)
-
-	_, contentParams, err := mime.ParseMediaType(resp.Header.Get("content-type"))
+	// eg. a plain "Error" when the device is too busy for another stream
+	mediaType, contentParams, err := mime.ParseMediaType(resp.Header.Get("content-type"))
+	if err == nil && (!strings.HasPrefix(mediaType, "multipart/") || contentParams["boundary"] == "") {
+		err = fmt.Errorf("expected a multipart stream, got %q", resp.Header.Get("content-type"))
+	}
 	if err != nil {
 		resp.Body.Close()
 		return nil, err
 	}
 	boundaryKeyword := contentParams["boundary"]
 
+	// Start read loop
+
+	s.Log.Info("Connection open, listening to stream...")
+	c := make(chan Event, 10)
+
 	go func() {
 		defer resp.Body.Close()
 		defer close(c)
-		mp := multipart.NewReader(resp.Body, boundaryKeyword)
-
-		for {
-			part, err := mp.NextPart()
-			if err != nil {
-				break
-			}
-
-			datalen, err := strconv.Atoi(part.Header.Get("content-length"))
-			if err != nil {
-				logrus.Warnf("Error reading stream length: %v", err)
-				part.Close()
-				continue
-			}
-
-			data := make([]byte, datalen)
-			_, err = part.Read(data)
-			if err != nil {
-				logrus.Warnf("Error reading stream data: %v", err)
-				part.Close()
-				continue
-			}
-			logrus.Debugf("Received %d bytes: %s", len(data), string(data))
-			c <- payloadToEvent(data)
-			part.Close()
+
+		var body io.Reader = resp.Body
+		var watchdog *heartbeatWatchdog
+		if heartbeat > 0 {
+			// Any data, heartbeat or event, proves the connection is alive. Closing the
+			// body unblocks the reader if it isn't
+			watchdog = newHeartbeatWatchdog(resp.Body, 2*heartbeat)
+			defer watchdog.Stop()
+			body = watchdog
 		}
 
-		logrus.Info("Closing event stream...")
+		err := readEventStream(s.Log, body, boundaryKeyword, s.EventCapture, c)
+
+		// The watchdog closing the body is what broke the read, if it expired
+		if watchdog != nil && watchdog.Expired() {
+			s.Log.Warnf("No heartbeat in %s, closing event stream", 2*heartbeat)
+			c <- Event{Err: ErrHeartbeatTimeout}
+		} else if err != nil {
+			c <- Event{Err: fmt.Errorf("%w: %v", ErrStreamLost, err)}
+		}
+		s.Log.Info("Closing event stream...")
 	}()
 
 	return c, nil
@@ -115,46 +109,40 @@ func (s *AmcrestDevice) buildLongHttp() xhttp.XHttp {
 	longhttp = &http.Client{
 		Timeout: 1 * time.Hour,
 	}
+	longhttp = newInstrumented(longhttp)
 	longhttp = xhttp.NewDigest(longhttp, s.username, s.password)
 	return longhttp
 }
 
-func payloadToEvent(payload []byte) (ret Event) {
-	bucket := parseStreamPayload(payload)
-
-	index, _ := strconv.Atoi(bucket["index"])
-	return Event{
-		Code:   bucket["code"],
-		Action: bucket["action"],
-		Index:  index,
-		Data:   bucket["data"],
-	}
+// Reader that closes the stream if nothing's read within `window`
+type heartbeatWatchdog struct {
+	r       io.ReadCloser
+	window  time.Duration
+	timer   *time.Timer
+	expired int32
 }
 
-func parseStreamPayload(payload []byte) (ret map[string]string) {
-	ret = make(map[string]string)
-
-	for len(payload) > 0 {
-		nextToken := bytes.IndexByte(payload, ';')
-		var slice []byte
-		if nextToken < 0 {
-			slice = payload
-		} else {
-			slice = payload[:nextToken]
-		}
-
-		if delimIndex := bytes.IndexByte(slice, '='); delimIndex > 0 {
-			key := strings.ToLower(string(slice[:delimIndex]))
-			val := string(slice[delimIndex+1:])
-			ret[key] = val
-		}
-
-		if nextToken < 0 {
-			break
-		}
+func newHeartbeatWatchdog(r io.ReadCloser, window time.Duration) *heartbeatWatchdog {
+	s := &heartbeatWatchdog{r: r, window: window}
+	s.timer = time.AfterFunc(window, func() {
+		atomic.StoreInt32(&s.expired, 1)
+		s.r.Close()
+	})
+	return s
+}
 
-		payload = payload[len(slice)+1:]
+func (s *heartbeatWatchdog) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(s.window)
 	}
+	return n, err
+}
+
+func (s *heartbeatWatchdog) Expired() bool {
+	return atomic.LoadInt32(&s.expired) == 1
+}
 
-	return
+func (s *heartbeatWatchdog) Stop() {
+	s.timer.Stop()
 }
@@ -1,9 +1,18 @@
 package amcrest
 
 import (
+	"bytes"
+	"errors"
+	"ha-adapters/pkg/xlog"
+	"io"
+	"net/textproto"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParsePayload(t *testing.T) {
@@ -25,3 +34,131 @@ func TestParsePayload(t *testing.T) {
 	assert.Len(t, parts, 0)
 	assert.Equal(t, map[string]string{}, parts)
 }
+
+func TestCaptureReplay(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewCaptureWriter(&buf)
+	start := time.Date(2023, 1, 20, 10, 56, 56, 0, time.UTC)
+	w.WriteRecord(CaptureRecord{Time: start, Payload: "Code=VideoMotion;action=Start;index=0"})
+	w.WriteRecord(CaptureRecord{Time: start.Add(2 * time.Second), Payload: "Code=VideoMotion;action=Stop;index=0"})
+
+	// 2s gap at 100x
+	began := time.Now()
+	var events []Event
+	for e := range ReplayCapture(bytes.NewReader(buf.Bytes()), 100, nil) {
+		events = append(events, e)
+	}
+	assert.GreaterOrEqual(t, time.Since(began), 20*time.Millisecond)
+
+	assert.Len(t, events, 2)
+	assert.Equal(t, "VideoMotion", events[0].Code)
+	assert.Equal(t, "Start", events[0].Action)
+	assert.Equal(t, "Stop", events[1].Action)
+}
+
+func TestReplayBadRecord(t *testing.T) {
+	var events []Event
+	for e := range ReplayCapture(strings.NewReader("{\"payload\":\"Code=A\"}\nnot json\n"), 0, nil) {
+		events = append(events, e)
+	}
+	assert.Len(t, events, 2)
+	assert.Equal(t, "A", events[0].Code)
+	assert.Error(t, events[1].Err)
+}
+
+func TestParsePayloadData(t *testing.T) {
+	parts := parseStreamPayload([]byte("Code=CrossRegionDetection;action=Start;index=0;data={\n \"Name\" : \"a;b=c\"\n}\n"))
+	assert.Equal(t, map[string]string{
+		"code":   "CrossRegionDetection",
+		"action": "Start",
+		"index":  "0",
+		"data":   "{\n \"Name\" : \"a;b=c\"\n}",
+	}, parts)
+}
+
+func readTestStream(raw string) (events []Event) {
+	c := make(chan Event, 100)
+	readEventStream(xlog.Component("amcrest"), strings.NewReader(raw), "myboundary", nil, c)
+	close(c)
+	for e := range c {
+		events = append(events, e)
+	}
+	return
+}
+
+func TestReadEventStreamError(t *testing.T) {
+	cut := errors.New("connection reset")
+	body := io.MultiReader(strings.NewReader("--myboundary\r\n"+
+		"Content-Type: text/plain\r\nContent-Length: 37\r\n\r\n"+
+		"Code=VideoMotion;action=Start;index=0\r\n"),
+		iotest.ErrReader(cut))
+
+	c := make(chan Event, 10)
+	err := readEventStream(xlog.Component("amcrest"), body, "myboundary", nil, c)
+	assert.ErrorIs(t, err, cut)
+	require.Len(t, c, 1)
+	assert.Equal(t, "VideoMotion", (<-c).Code)
+
+	// The device ending it isn't an error
+	err = readEventStream(xlog.Component("amcrest"), strings.NewReader("--myboundary--\r\n"), "myboundary", nil, c)
+	assert.NoError(t, err)
+}
+
+func TestReadEventStream(t *testing.T) {
+	events := readTestStream("--myboundary\r\n" +
+		"Content-Type: text/plain\r\nContent-Length: 37\r\n\r\n" +
+		"Code=VideoMotion;action=Start;index=0\r\n" +
+		// Heartbeat, skipped
+		"--myboundary\r\nContent-Type: text/plain\r\nContent-Length: 9\r\n\r\nHeartbeat\r\n" +
+		// No content-length
+		"--myboundary\r\nContent-Type: text/plain\r\n\r\n" +
+		"Code=_DoTalkAction_;action=Pulse;index=0;data={\"Action\" : \"Invite\"}\r\n" +
+		// No code
+		"--myboundary\r\nContent-Type: text/plain\r\n\r\ngarbage\r\n" +
+		// Claims more than it has
+		"--myboundary\r\nContent-Length: 100\r\n\r\nCode=Short\r\n" +
+		"--myboundary\r\nContent-Length: 36\r\n\r\nCode=VideoMotion;action=Stop;index=0\r\n" +
+		"--myboundary--\r\n")
+
+	require.Len(t, events, 5)
+	assert.Equal(t, "Start", events[0].Action)
+
+	assert.Equal(t, "_DoTalkAction_", events[1].Code)
+	assert.Equal(t, `{"Action" : "Invite"}`, events[1].Data)
+
+	assert.ErrorIs(t, events[2].Err, ErrMissingCode)
+	assert.True(t, IsMalformedPart(events[2].Err))
+
+	assert.ErrorIs(t, events[3].Err, ErrShortPart)
+
+	assert.NoError(t, events[4].Err)
+	assert.Equal(t, "Stop", events[4].Action)
+}
+
+func TestReadEventStreamBadHeader(t *testing.T) {
+	events := readTestStream("--myboundary\r\nbroken header\r\n\r\nCode=A\r\n" +
+		"--myboundary\r\nContent-Length: 6\r\n\r\nCode=B\r\n" +
+		"--myboundary--\r\n")
+
+	// Reported, and the stream carries on
+	require.NotEmpty(t, events)
+	assert.True(t, IsMalformedPart(events[0].Err))
+	last := events[len(events)-1]
+	assert.NoError(t, last.Err)
+	assert.Equal(t, "B", last.Code)
+}
+
+func TestReadMultipart(t *testing.T) {
+	raw := "--myboundary\r\nContent-Type: text/plain\r\nContent-Length: 9\r\n\r\nHeartbeat\r\n" +
+		"--myboundary\r\nContent-Type: text/plain\r\n\r\nCode=VideoMotion;action=Start;index=0\r\n" +
+		"--myboundary--\r\n"
+
+	var parts []string
+	err := ReadMultipart(strings.NewReader(raw), "myboundary", func(header textproto.MIMEHeader, data []byte) error {
+		assert.Equal(t, "text/plain", header.Get("Content-Type"))
+		parts = append(parts, string(data))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Heartbeat", "Code=VideoMotion;action=Start;index=0"}, parts)
+}
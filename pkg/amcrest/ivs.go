@@ -0,0 +1,79 @@
+package amcrest
+
+import (
+	"fmt"
+	"ha-adapters/pkg/parsers"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An intelligent video (IVS) rule, eg. a tripwire or region the user drew
+type IVSRule struct {
+	Channel, Index int
+	Name           string
+	Type           string // Event code it raises, eg. CrossRegionDetection
+	Enable         bool
+}
+
+var ivsRuleKeyRegex = regexp.MustCompile(`^VideoAnalyseRule\[(\d+)\]\[(\d+)\]\.(Name|Type|Enable)$`)
+
+func (s *AmcrestDevice) GetIVSRules() ([]IVSRule, error) {
+	config, err := s.getConfigNamed("VideoAnalyseRule")
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make(map[[2]int]*IVSRule)
+	for k, v := range config {
+		m := ivsRuleKeyRegex.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		channel, _ := strconv.Atoi(m[1])
+		index, _ := strconv.Atoi(m[2])
+
+		key := [2]int{channel, index}
+		rule := rules[key]
+		if rule == nil {
+			rule = &IVSRule{Channel: channel, Index: index}
+			rules[key] = rule
+		}
+
+		switch m[3] {
+		case "Name":
+			rule.Name = v
+		case "Type":
+			rule.Type = v
+		case "Enable":
+			rule.Enable = strings.EqualFold(v, "true")
+		}
+	}
+
+	ret := make([]IVSRule, 0, len(rules))
+	for _, rule := range rules {
+		ret = append(ret, *rule)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Channel != ret[j].Channel {
+			return ret[i].Channel < ret[j].Channel
+		}
+		return ret[i].Index < ret[j].Index
+	})
+	return ret, nil
+}
+
+// Config for one table, with the "table." prefix removed
+func (s *AmcrestDevice) getConfigNamed(name string) (map[string]string, error) {
+	info, err := s.request(fmt.Sprintf("/cgi-bin/configManager.cgi?action=getConfig&name=%s", name))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]string)
+	for k, v := range parsers.ParseManyKV(info, '\n') {
+		ret[strings.TrimPrefix(k, "table.")] = v
+	}
+	return ret, nil
+}
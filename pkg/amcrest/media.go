@@ -1,10 +1,20 @@
 package amcrest
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"ha-adapters/pkg/dav"
+	"ha-adapters/pkg/xfs"
 	"io"
 	"os"
+	"time"
+)
 
-	"github.com/sirupsen/logrus"
+var (
+	ErrFileNotClosed  = errors.New("timed out waiting for file to close")
+	ErrLengthMismatch = errors.New("downloaded length mismatch")
+	ErrUnknownLength  = errors.New("device didn't send the file's length")
 )
 
 func (s *AmcrestDevice) DownloadFile(path string) (io.ReadCloser, error) {
@@ -12,38 +22,134 @@ func (s *AmcrestDevice) DownloadFile(path string) (io.ReadCloser, error) {
 	return s.requestStream("/cgi-bin/RPC_Loadfile" + path)
 }
 
-// Called with `path` from a `NewFile` event
-func (s *AmcrestDevice) DownloadFileTo(path, to string) error {
-	stream, err := s.DownloadFile(path)
+// Called with `path` from a `NewFile` event. The file is only moved into place once
+// it has been completely written and verified
+func (s *AmcrestDevice) DownloadFileTo(path, to string) (written int64, err error) {
+	resp, err := s.requestResponse("/cgi-bin/RPC_Loadfile" + path)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer stream.Close()
+	defer resp.Body.Close()
 
-	f, err := os.Create(to)
+	err = xfs.WriteAtomic(to, func(f *os.File) error {
+		written, err = io.Copy(f, resp.Body)
+		if err != nil {
+			return err
+		}
+		return verifyLength(resp.ContentLength, written)
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer f.Close()
 
-	var total uint64
+	s.Log.Debugf("Wrote %d bytes to %s", written, to)
+
+	return written, nil
+}
 
-	buf := make([]byte, 1024*4)
+// Clips are announced by `NewFile` as soon as the device starts recording them, so
+// the length is polled until it stops growing
+func (s *AmcrestDevice) WaitForFileClosed(path string, interval, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	last := int64(-1)
 	for {
-		n, err := stream.Read(buf)
-		if n > 0 {
-			total += uint64(n)
-			f.Write(buf[:n])
+		size, err := s.fileLength(path)
+		if err != nil {
+			return err
+		}
+		if size > 0 && size == last {
+			return nil
+		}
+		s.Log.Tracef("%s is %d bytes, waiting...", path, size)
+		last = size
+
+		if time.Now().Add(interval).After(deadline) {
+			return ErrFileNotClosed
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (s *AmcrestDevice) fileLength(path string) (int64, error) {
+	resp, err := s.requestResponse("/cgi-bin/RPC_Loadfile" + path)
+	if err != nil {
+		return 0, err
+	}
+	// Only the headers are wanted; closing early drops the rest
+	defer resp.Body.Close()
+
+	if resp.ContentLength < 0 {
+		// Would mean downloading the whole clip every poll
+		return 0, ErrUnknownLength
+	}
+	return resp.ContentLength, nil
+}
+
+// Download a recorded clip once the device has finished writing it. The device
+// records DAV (regardless of file extension), which is remuxed to MP4
+func (s *AmcrestDevice) DownloadClipTo(path, to string) (written int64, err error) {
+	if err := s.WaitForFileClosed(path, s.ClipPollInterval, s.ClipTimeout); err != nil {
+		return 0, err
+	}
+
+	resp, err := s.requestResponse("/cgi-bin/RPC_Loadfile" + path)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	err = xfs.WriteAtomic(to, func(f *os.File) error {
+		counter := &countingReader{r: resp.Body}
+		br := bufio.NewReader(counter)
+
+		if !dav.Sniff(br) {
+			// Already something playable, keep as-is
+			if _, err := io.Copy(f, br); err != nil {
+				return err
+			}
+		} else {
+			stats, err := dav.RemuxToMP4(br, f)
+			if err != nil {
+				return err
+			}
+			s.Log.Debugf("Remuxed %s clip (%dx%d, %d frames, %dms)",
+				stats.Codec, stats.Width, stats.Height, stats.Frames, stats.Duration)
 		}
-		if err == io.EOF {
-			break
+
+		if err := verifyLength(resp.ContentLength, counter.n); err != nil {
+			return err
 		}
+
+		info, err := f.Stat()
 		if err != nil {
 			return err
 		}
+		written = info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	logrus.Debugf("Wrote %d bytes to %s", total, to)
+	s.Log.Debugf("Wrote %d bytes to %s", written, to)
 
+	return written, nil
+}
+
+func verifyLength(expected, actual int64) error {
+	if expected >= 0 && expected != actual {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrLengthMismatch, expected, actual)
+	}
 	return nil
 }
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (s *countingReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	return n, err
+}
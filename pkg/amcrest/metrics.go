@@ -0,0 +1,16 @@
+package amcrest
+
+import "ha-adapters/pkg/metrics"
+
+var (
+	metricEvents = metrics.NewCounter("amcrest_events_total",
+		"Events dispatched from the event stream", "code", "action")
+	metricEventErrors = metrics.NewCounter("amcrest_event_errors_total",
+		"Malformed events, and other event stream errors")
+	metricEventsDropped = metrics.NewCounter("amcrest_events_dropped_total",
+		"Events dropped because their handler was backed up", "code")
+	metricStreamReconnects = metrics.NewCounter("amcrest_event_stream_reconnects_total",
+		"Event stream connection attempts, after the first")
+	metricStreamConnected = metrics.NewGauge("amcrest_event_stream_connected",
+		"1 while the event stream is connected")
+)
@@ -0,0 +1,92 @@
+package amcrest
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type StreamStatus string
+
+const (
+	STREAM_CONNECTING   StreamStatus = "connecting"
+	STREAM_CONNECTED    StreamStatus = "connected"
+	STREAM_DISCONNECTED StreamStatus = "disconnected"
+)
+
+type StreamState struct {
+	Status  StreamStatus
+	Attempt int   // Sequential failed attempts so far
+	Err     error // Why we disconnected, or failed to connect
+}
+
+// Keeps an event stream open, reconnecting with exponential backoff (`StreamBackoff`
+// doubling up to `StreamMaxBackoff`). Gives up after `maxSequentialRetries` failed
+// attempts in a row, sending a final `Err` event; 0 or less never gives up.
+// Connection changes are reported to `OnStreamStatus`, if set
+func (s *AmcrestDevice) OpenReliableEventStream(maxSequentialRetries int) <-chan Event {
+	c := make(chan Event, 10)
+	go func() {
+		defer close(c)
+
+		backoff := s.StreamBackoff
+		var lastErr error
+		first := true
+		for retries := 0; maxSequentialRetries <= 0 || retries < maxSequentialRetries; retries++ {
+			if retries > 0 {
+				s.Log.Warnf("Error opening stream, retrying in %s: %v", backoff, lastErr)
+				time.Sleep(backoff)
+				backoff *= 2
+				if backoff > s.StreamMaxBackoff {
+					backoff = s.StreamMaxBackoff
+				}
+			}
+
+			if !first {
+				metricStreamReconnects.With().Inc()
+			}
+			first = false
+
+			s.reportStream(StreamState{Status: STREAM_CONNECTING, Attempt: retries})
+			stream, err := s.OpenEventStream()
+			if err != nil {
+				lastErr = err
+				s.reportStream(StreamState{Status: STREAM_DISCONNECTED, Attempt: retries + 1, Err: err})
+				continue
+			}
+
+			retries = -1 // reset! Success!
+			backoff = s.StreamBackoff
+			s.reportStream(StreamState{Status: STREAM_CONNECTED})
+
+			var streamErr error
+			for event := range stream {
+				// Why it ended; anything else is for the caller
+				if errors.Is(event.Err, ErrHeartbeatTimeout) || errors.Is(event.Err, ErrStreamLost) {
+					streamErr = event.Err
+					continue
+				}
+				c <- event
+			}
+
+			s.Log.Warn("Event stream ended, reconnecting...")
+			s.reportStream(StreamState{Status: STREAM_DISCONNECTED, Err: streamErr})
+			time.Sleep(s.StreamBackoff)
+		}
+
+		c <- Event{Err: fmt.Errorf("event stream: giving up after %d attempts: %w", maxSequentialRetries, lastErr)}
+	}()
+	return c
+}
+
+func (s *AmcrestDevice) reportStream(state StreamState) {
+	connected := 0.0
+	if state.Status == STREAM_CONNECTED {
+		connected = 1
+	}
+	metricStreamConnected.With().Set(connected)
+
+	if s.OnStreamStatus != nil {
+		s.OnStreamStatus(state)
+	}
+}
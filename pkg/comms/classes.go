@@ -0,0 +1,310 @@
+package comms
+
+import (
+	"fmt"
+)
+
+/*
+Home Assistant's device_class, state_class and unit catalogs, so a typo is
+caught when advertising rather than showing up as a broken entity in HA.
+See https://www.home-assistant.io/integrations/sensor/#device-class
+*/
+
+// Binary sensor device classes
+var (
+	SC_BATTERY          SensorClassType = "battery"
+	SC_BATTERY_CHARGING SensorClassType = "battery_charging"
+	SC_CARBON_MONOXIDE  SensorClassType = "carbon_monoxide"
+	SC_COLD             SensorClassType = "cold"
+	SC_CONNECTIVITY     SensorClassType = "connectivity"
+	SC_DOOR             SensorClassType = "door"
+	SC_GARAGE_DOOR      SensorClassType = "garage_door"
+	SC_GAS              SensorClassType = "gas"
+	SC_HEAT             SensorClassType = "heat"
+	SC_LIGHT            SensorClassType = "light"
+	SC_LOCK             SensorClassType = "lock"
+	SC_MOISTURE         SensorClassType = "moisture"
+	SC_MOTION           SensorClassType = "motion"
+	SC_MOVING           SensorClassType = "moving"
+	SC_OCCUPANCY        SensorClassType = "occupancy"
+	SC_OPENING          SensorClassType = "opening"
+	SC_PLUG             SensorClassType = "plug"
+	SC_POWER            SensorClassType = "power"
+	SC_PRESENCE         SensorClassType = "presence"
+	SC_PROBLEM          SensorClassType = "problem"
+	SC_RUNNING          SensorClassType = "running"
+	SC_SAFETY           SensorClassType = "safety"
+	SC_SMOKE            SensorClassType = "smoke"
+	SC_SOUND            SensorClassType = "sound"
+	SC_TAMPER           SensorClassType = "tamper"
+	SC_UPDATE           SensorClassType = "update"
+	SC_VIBRATION        SensorClassType = "vibration"
+	SC_WINDOW           SensorClassType = "window"
+)
+
+// Sensor (and number) device classes. Some share a name with a binary
+// sensor class above (battery, gas, moisture, power)
+var (
+	SC_APPARENT_POWER          SensorClassType = "apparent_power"
+	SC_AQI                     SensorClassType = "aqi"
+	SC_ATMOSPHERIC_PRESSURE    SensorClassType = "atmospheric_pressure"
+	SC_CARBON_DIOXIDE          SensorClassType = "carbon_dioxide"
+	SC_CURRENT                 SensorClassType = "current"
+	SC_DATA_RATE               SensorClassType = "data_rate"
+	SC_DATA_SIZE               SensorClassType = "data_size"
+	SC_DATE                    SensorClassType = "date"
+	SC_DISTANCE                SensorClassType = "distance"
+	SC_DURATION                SensorClassType = "duration"
+	SC_ENERGY                  SensorClassType = "energy"
+	SC_ENERGY_STORAGE          SensorClassType = "energy_storage"
+	SC_ENUM                    SensorClassType = "enum"
+	SC_FREQUENCY               SensorClassType = "frequency"
+	SC_HUMIDITY                SensorClassType = "humidity"
+	SC_ILLUMINANCE             SensorClassType = "illuminance"
+	SC_IRRADIANCE              SensorClassType = "irradiance"
+	SC_MONETARY                SensorClassType = "monetary"
+	SC_NITROGEN_DIOXIDE        SensorClassType = "nitrogen_dioxide"
+	SC_NITROGEN_MONOXIDE       SensorClassType = "nitrogen_monoxide"
+	SC_NITROUS_OXIDE           SensorClassType = "nitrous_oxide"
+	SC_OZONE                   SensorClassType = "ozone"
+	SC_PH                      SensorClassType = "ph"
+	SC_PM1                     SensorClassType = "pm1"
+	SC_PM10                    SensorClassType = "pm10"
+	SC_PM25                    SensorClassType = "pm25"
+	SC_POWER_FACTOR            SensorClassType = "power_factor"
+	SC_PRECIPITATION           SensorClassType = "precipitation"
+	SC_PRECIPITATION_INTENSITY SensorClassType = "precipitation_intensity"
+	SC_PRESSURE                SensorClassType = "pressure"
+	SC_REACTIVE_POWER          SensorClassType = "reactive_power"
+	SC_SIGNAL_STRENGTH         SensorClassType = "signal_strength"
+	SC_SOUND_PRESSURE          SensorClassType = "sound_pressure"
+	SC_SPEED                   SensorClassType = "speed"
+	SC_SULPHUR_DIOXIDE         SensorClassType = "sulphur_dioxide"
+	SC_TEMPERATURE             SensorClassType = "temperature"
+	SC_TIMESTAMP               SensorClassType = "timestamp"
+	SC_VOLATILE_ORGANIC        SensorClassType = "volatile_organic_compounds"
+	SC_VOLATILE_ORGANIC_PARTS  SensorClassType = "volatile_organic_compounds_parts"
+	SC_VOLTAGE                 SensorClassType = "voltage"
+	SC_VOLUME                  SensorClassType = "volume"
+	SC_VOLUME_FLOW_RATE        SensorClassType = "volume_flow_rate"
+	SC_VOLUME_STORAGE          SensorClassType = "volume_storage"
+	SC_WATER                   SensorClassType = "water"
+	SC_WEIGHT                  SensorClassType = "weight"
+	SC_WIND_DIRECTION          SensorClassType = "wind_direction"
+	SC_WIND_SPEED              SensorClassType = "wind_speed"
+	SC_IDENTIFY                SensorClassType = "identify" // button
+	SC_RESTART                 SensorClassType = "restart"  // button
+	SC_OUTLET                  SensorClassType = "outlet"   // switch
+	SC_SWITCH                  SensorClassType = "switch"   // switch
+	SC_FIRMWARE                SensorClassType = "firmware" // update
+	SC_BUTTON                  SensorClassType = "button"   // event
+	SC_DOORBELL                SensorClassType = "doorbell" // event
+)
+
+// Sensor state classes; a sensor with one gets long-term statistics in HA
+type StateClass string
+
+const (
+	STATE_CLASS_MEASUREMENT      StateClass = "measurement"
+	STATE_CLASS_TOTAL            StateClass = "total"
+	STATE_CLASS_TOTAL_INCREASING StateClass = "total_increasing"
+)
+
+// Units, as HA spells them
+const (
+	UNIT_PERCENT = "%"
+
+	UNIT_BYTES     = "B"
+	UNIT_KILOBYTES = "kB"
+	UNIT_MEGABYTES = "MB"
+	UNIT_GIGABYTES = "GB"
+	UNIT_TERABYTES = "TB"
+	UNIT_KIBIBYTES = "KiB"
+	UNIT_MEBIBYTES = "MiB"
+	UNIT_GIBIBYTES = "GiB"
+	UNIT_TEBIBYTES = "TiB"
+
+	UNIT_MILLISECONDS = "ms"
+	UNIT_SECONDS      = "s"
+	UNIT_MINUTES      = "min"
+	UNIT_HOURS        = "h"
+	UNIT_DAYS         = "d"
+
+	UNIT_CELSIUS    = "°C"
+	UNIT_FAHRENHEIT = "°F"
+	UNIT_KELVIN     = "K"
+
+	UNIT_WATT      = "W"
+	UNIT_KILOWATT  = "kW"
+	UNIT_VOLT      = "V"
+	UNIT_MILLIVOLT = "mV"
+	UNIT_AMPERE    = "A"
+	UNIT_MILLIAMP  = "mA"
+
+	UNIT_DB  = "dB"
+	UNIT_DBM = "dBm"
+	UNIT_LUX = "lx"
+	UNIT_PPM = "ppm"
+	UNIT_PPB = "ppb"
+)
+
+type deviceClassSpec struct {
+	// Units the class may be used with, "" meaning none. nil allows any unit
+	Units []string
+	// Allowed state classes, nil allows any
+	StateClasses []StateClass
+}
+
+var (
+	unitless     = []string{""}
+	noStateClass = []StateClass{}
+
+	pressureUnits = []string{"cbar", "bar", "hPa", "mmHg", "inHg", "kPa", "mbar", "Pa", "psi"}
+	speedUnits    = []string{"ft/s", "in/d", "in/h", "km/h", "kn", "m/s", "mph", "mm/d", "mm/s"}
+	volumeUnits   = []string{"L", "mL", "gal", "fl. oz.", "m³", "ft³", "CCF"}
+	energyUnits   = []string{"Wh", "kWh", "MWh", "GWh", "MJ", "GJ"}
+	airUnits      = []string{"µg/m³"}
+	totalsOnly    = []StateClass{STATE_CLASS_TOTAL, STATE_CLASS_TOTAL_INCREASING}
+)
+
+var sensorClasses = map[SensorClassType]deviceClassSpec{
+	SC_APPARENT_POWER:          {Units: []string{"VA"}},
+	SC_AQI:                     {Units: unitless},
+	SC_ATMOSPHERIC_PRESSURE:    {Units: pressureUnits},
+	SC_BATTERY:                 {Units: []string{UNIT_PERCENT}},
+	SC_CARBON_DIOXIDE:          {Units: []string{UNIT_PPM}},
+	SC_CARBON_MONOXIDE:         {Units: []string{UNIT_PPM}},
+	SC_CURRENT:                 {Units: []string{UNIT_AMPERE, UNIT_MILLIAMP}},
+	SC_DATA_RATE:               {Units: []string{"bit/s", "kbit/s", "Mbit/s", "Gbit/s", "B/s", "kB/s", "MB/s", "GB/s", "KiB/s", "MiB/s", "GiB/s"}},
+	SC_DATA_SIZE:               {Units: []string{"bit", "kbit", "Mbit", "Gbit", UNIT_BYTES, UNIT_KILOBYTES, UNIT_MEGABYTES, UNIT_GIGABYTES, UNIT_TERABYTES, "PB", "EB", "ZB", "YB", UNIT_KIBIBYTES, UNIT_MEBIBYTES, UNIT_GIBIBYTES, UNIT_TEBIBYTES, "PiB", "EiB", "ZiB", "YiB"}},
+	SC_DATE:                    {Units: unitless, StateClasses: noStateClass},
+	SC_DISTANCE:                {Units: []string{"km", "m", "cm", "mm", "mi", "yd", "ft", "in"}},
+	SC_DURATION:                {Units: []string{UNIT_DAYS, UNIT_HOURS, UNIT_MINUTES, UNIT_SECONDS, UNIT_MILLISECONDS}},
+	SC_ENERGY:                  {Units: energyUnits, StateClasses: totalsOnly},
+	SC_ENERGY_STORAGE:          {Units: energyUnits},
+	SC_ENUM:                    {Units: unitless, StateClasses: noStateClass},
+	SC_FREQUENCY:               {Units: []string{"Hz", "kHz", "MHz", "GHz"}},
+	SC_GAS:                     {Units: []string{"m³", "ft³", "CCF"}, StateClasses: totalsOnly},
+	SC_HUMIDITY:                {Units: []string{UNIT_PERCENT}},
+	SC_ILLUMINANCE:             {Units: []string{UNIT_LUX}},
+	SC_IRRADIANCE:              {Units: []string{"W/m²", "BTU/(h⋅ft²)"}},
+	SC_MOISTURE:                {Units: []string{UNIT_PERCENT}},
+	SC_MONETARY:                {}, // Any ISO 4217 currency
+	SC_NITROGEN_DIOXIDE:        {Units: airUnits},
+	SC_NITROGEN_MONOXIDE:       {Units: airUnits},
+	SC_NITROUS_OXIDE:           {Units: airUnits},
+	SC_OZONE:                   {Units: airUnits},
+	SC_PH:                      {Units: unitless},
+	SC_PM1:                     {Units: airUnits},
+	SC_PM10:                    {Units: airUnits},
+	SC_PM25:                    {Units: airUnits},
+	SC_POWER:                   {Units: []string{UNIT_WATT, UNIT_KILOWATT, "MW", "GW", "TW"}},
+	SC_POWER_FACTOR:            {Units: []string{"", UNIT_PERCENT}},
+	SC_PRECIPITATION:           {Units: []string{"cm", "in", "mm"}},
+	SC_PRECIPITATION_INTENSITY: {Units: []string{"in/d", "in/h", "mm/d", "mm/h"}},
+	SC_PRESSURE:                {Units: pressureUnits},
+	SC_REACTIVE_POWER:          {Units: []string{"var"}},
+	SC_SIGNAL_STRENGTH:         {Units: []string{UNIT_DB, UNIT_DBM}},
+	SC_SOUND_PRESSURE:          {Units: []string{UNIT_DB, "dBA"}},
+	SC_SPEED:                   {Units: speedUnits},
+	SC_SULPHUR_DIOXIDE:         {Units: airUnits},
+	SC_TEMPERATURE:             {Units: []string{UNIT_CELSIUS, UNIT_FAHRENHEIT, UNIT_KELVIN}},
+	SC_TIMESTAMP:               {Units: unitless, StateClasses: noStateClass},
+	SC_VOLATILE_ORGANIC:        {Units: airUnits},
+	SC_VOLATILE_ORGANIC_PARTS:  {Units: []string{UNIT_PPM, UNIT_PPB}},
+	SC_VOLTAGE:                 {Units: []string{UNIT_VOLT, UNIT_MILLIVOLT, "µV", "kV", "MV"}},
+	SC_VOLUME:                  {Units: volumeUnits, StateClasses: totalsOnly},
+	SC_VOLUME_FLOW_RATE:        {Units: []string{"m³/h", "ft³/min", "L/min", "gal/min", "mL/s"}},
+	SC_VOLUME_STORAGE:          {Units: volumeUnits},
+	SC_WATER:                   {Units: []string{"L", "gal", "m³", "ft³", "CCF"}, StateClasses: totalsOnly},
+	SC_WEIGHT:                  {Units: []string{"kg", "g", "mg", "µg", "oz", "lb", "st"}},
+	SC_WIND_DIRECTION:          {Units: []string{"°"}},
+	SC_WIND_SPEED:              {Units: speedUnits},
+}
+
+// Device classes for the platforms that have them, besides sensor & number
+var platformClasses = map[SensorType][]SensorClassType{
+	ST_BINARY_SENSOR: {
+		SC_BATTERY, SC_BATTERY_CHARGING, SC_CARBON_MONOXIDE, SC_COLD, SC_CONNECTIVITY,
+		SC_DOOR, SC_GARAGE_DOOR, SC_GAS, SC_HEAT, SC_LIGHT, SC_LOCK, SC_MOISTURE,
+		SC_MOTION, SC_MOVING, SC_OCCUPANCY, SC_OPENING, SC_PLUG, SC_POWER, SC_PRESENCE,
+		SC_PROBLEM, SC_RUNNING, SC_SAFETY, SC_SMOKE, SC_SOUND, SC_TAMPER, SC_UPDATE,
+		SC_VIBRATION, SC_WINDOW,
+	},
+	ST_BUTTON: {SC_IDENTIFY, SC_RESTART, SC_UPDATE},
+	ST_SWITCH: {SC_OUTLET, SC_SWITCH},
+	ST_UPDATE: {SC_FIRMWARE},
+	ST_EVENT:  {SC_BUTTON, SC_DOORBELL, SC_MOTION},
+}
+
+// Checks the sensor's device class, unit and state class against HA's
+// catalogs, and each other. Sensors without a device class can have any unit
+func (s *Sensor) ValidateClasses() error {
+	switch s.Type {
+	case ST_SENSOR:
+		return s.validateSensorClasses()
+	case ST_NUMBER:
+		if s.StateClass != "" {
+			return fmt.Errorf("%s %q: state_class is only for sensors", s.Type, s.Name)
+		}
+		if s.ClassType == SC_DATE || s.ClassType == SC_ENUM || s.ClassType == SC_TIMESTAMP {
+			return fmt.Errorf("%s %q: invalid device_class %q", s.Type, s.Name, s.ClassType)
+		}
+		return s.validateSensorClasses()
+	}
+
+	if s.StateClass != "" {
+		return fmt.Errorf("%s %q: state_class is only for sensors", s.Type, s.Name)
+	}
+	if s.ClassType == "" {
+		return nil
+	}
+	for _, class := range platformClasses[s.Type] {
+		if class == s.ClassType {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %q: invalid device_class %q", s.Type, s.Name, s.ClassType)
+}
+
+func (s *Sensor) validateSensorClasses() error {
+	switch s.StateClass {
+	case "", STATE_CLASS_MEASUREMENT, STATE_CLASS_TOTAL, STATE_CLASS_TOTAL_INCREASING:
+	default:
+		return fmt.Errorf("%s %q: invalid state_class %q", s.Type, s.Name, s.StateClass)
+	}
+
+	if s.ClassType == "" {
+		return nil
+	}
+	spec, ok := sensorClasses[s.ClassType]
+	if !ok {
+		return fmt.Errorf("%s %q: invalid device_class %q", s.Type, s.Name, s.ClassType)
+	}
+
+	if spec.Units != nil && !containsString(spec.Units, s.UnitOfMeasurement) {
+		if s.UnitOfMeasurement == "" {
+			return fmt.Errorf("%s %q: device_class %s needs a unit, one of %q", s.Type, s.Name, s.ClassType, spec.Units)
+		}
+		return fmt.Errorf("%s %q: unit %q is invalid for device_class %s", s.Type, s.Name, s.UnitOfMeasurement, s.ClassType)
+	}
+
+	if s.StateClass != "" && spec.StateClasses != nil {
+		for _, sc := range spec.StateClasses {
+			if sc == s.StateClass {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s %q: state_class %s is invalid for device_class %s", s.Type, s.Name, s.StateClass, s.ClassType)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package comms
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateClasses(t *testing.T) {
+	tests := []struct {
+		sensor Sensor
+		err    string
+	}{
+		{Sensor{Type: ST_SENSOR, UnitOfMeasurement: "furlongs"}, ""},
+		{Sensor{Type: ST_SENSOR, ClassType: SC_DATA_SIZE, UnitOfMeasurement: "GB", StateClass: STATE_CLASS_MEASUREMENT}, ""},
+		{Sensor{Type: ST_SENSOR, ClassType: SC_DATA_SIZE, UnitOfMeasurement: "%"}, `sensor "X": unit "%" is invalid for device_class data_size`},
+		{Sensor{Type: ST_SENSOR, ClassType: SC_TEMPERATURE}, `sensor "X": device_class temperature needs a unit, one of ["°C" "°F" "K"]`},
+		{Sensor{Type: ST_SENSOR, ClassType: SC_POWER_FACTOR}, ""},
+		{Sensor{Type: ST_SENSOR, ClassType: SC_MONETARY, UnitOfMeasurement: "NZD", StateClass: STATE_CLASS_TOTAL}, ""},
+		{Sensor{Type: ST_SENSOR, ClassType: "temprature", UnitOfMeasurement: "°C"}, `sensor "X": invalid device_class "temprature"`},
+		{Sensor{Type: ST_SENSOR, StateClass: "measurment"}, `sensor "X": invalid state_class "measurment"`},
+		{Sensor{Type: ST_SENSOR, ClassType: SC_ENERGY, UnitOfMeasurement: "kWh", StateClass: STATE_CLASS_MEASUREMENT}, `sensor "X": state_class measurement is invalid for device_class energy`},
+		{Sensor{Type: ST_SENSOR, ClassType: SC_TIMESTAMP, StateClass: STATE_CLASS_MEASUREMENT}, `sensor "X": state_class measurement is invalid for device_class timestamp`},
+		{Sensor{Type: ST_BINARY_SENSOR, ClassType: SC_MOTION}, ""},
+		{Sensor{Type: ST_BINARY_SENSOR, ClassType: SC_TEMPERATURE}, `binary_sensor "X": invalid device_class "temperature"`},
+		{Sensor{Type: ST_BINARY_SENSOR, StateClass: STATE_CLASS_MEASUREMENT}, `binary_sensor "X": state_class is only for sensors`},
+		{Sensor{Type: ST_NUMBER, ClassType: SC_DURATION, UnitOfMeasurement: "s"}, ""},
+		{Sensor{Type: ST_NUMBER, ClassType: SC_ENUM}, `number "X": invalid device_class "enum"`},
+		{Sensor{Type: ST_BUTTON, ClassType: SC_RESTART}, ""},
+		{Sensor{Type: ST_LIGHT, ClassType: SC_LIGHT}, `light "X": invalid device_class "light"`},
+	}
+
+	for _, test := range tests {
+		test.sensor.Name = "X"
+		err := test.sensor.ValidateClasses()
+		if test.err == "" {
+			assert.NoError(t, err, "%+v", test.sensor)
+		} else {
+			assert.EqualError(t, err, test.err, "%+v", test.sensor)
+		}
+	}
+}
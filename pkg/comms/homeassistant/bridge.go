@@ -0,0 +1,178 @@
+package homeassistant
+
+import (
+	"ha-adapters/pkg/comms"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+The adapter process itself, as the device every other device is `via`. Has
+diagnostic sensors for how the adapter is doing, rather than any hardware
+*/
+
+const maxStateLength = 255 // HA won't take longer states
+
+type Bridge struct {
+	ha     *HomeAssistant
+	device comms.DeviceClass
+
+	version, uptime, connected, lastError, reconnects comms.Sensor
+
+	mu           sync.Mutex
+	devices      map[string]string // Identifier -> name, of connected devices
+	lastErrorMsg string
+	lastErrorAt  time.Time
+
+	shutdown chan struct{}
+}
+
+// Advertise the bridge, named after the adapter (eg. "ad410"), and keep its
+// sensors up to date until `Close`
+func NewBridge(ha *HomeAssistant, adapter, version string) *Bridge {
+	device := comms.DeviceClass{
+		DeviceName:   "ha-adapters " + adapter,
+		Manufacturer: "ha-adapters",
+		Model:        adapter,
+		Identifier:   Default_HA_Via,
+		Version:      version,
+	}
+	diagnostic := func(name, icon string) comms.Sensor {
+		return comms.Sensor{
+			DeviceClass: device,
+			Type:        comms.ST_SENSOR,
+			Name:        name,
+			Icon:        icon,
+			Category:    comms.EC_DIAGNOSTIC,
+		}
+	}
+
+	s := &Bridge{
+		ha:         ha,
+		device:     device,
+		version:    diagnostic("Version", "mdi:tag"),
+		uptime:     diagnostic("Uptime", "mdi:timer-outline"),
+		connected:  diagnostic("Connected Devices", "mdi:devices"),
+		lastError:  diagnostic("Last Error", "mdi:alert-circle"),
+		reconnects: diagnostic("MQTT Reconnects", "mdi:lan-pending"),
+		devices:    make(map[string]string),
+		shutdown:   make(chan struct{}),
+	}
+	s.uptime.ClassType = comms.SC_DURATION
+	s.uptime.UnitOfMeasurement = comms.UNIT_SECONDS
+	s.uptime.StateClass = comms.STATE_CLASS_MEASUREMENT
+	s.connected.StateClass = comms.STATE_CLASS_MEASUREMENT
+	s.connected.HasAttributes = true
+	s.lastError.HasAttributes = true
+	s.reconnects.StateClass = comms.STATE_CLASS_TOTAL_INCREASING
+
+	for _, sensor := range s.sensors() {
+		if err := ha.Advertise(sensor); err != nil {
+			ha.Log.Errorf("Unable to advertise bridge sensor: %v", err)
+		}
+	}
+
+	started := time.Now()
+	go func() {
+		// States aren't retained, so republish them every so often
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for {
+			s.publish(time.Since(started))
+			select {
+			case <-s.shutdown:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *Bridge) Close() error {
+	close(s.shutdown)
+	return nil
+}
+
+// The bridge's device, eg. to advertise more sensors on it
+func (s *Bridge) Device() comms.DeviceClass {
+	return s.device
+}
+
+// Track a device as connected, or not, through the bridge
+func (s *Bridge) DeviceConnected(dc comms.DeviceClass, connected bool) {
+	s.mu.Lock()
+	_, was := s.devices[dc.Identifier]
+	if connected {
+		s.devices[dc.Identifier] = dc.DeviceName
+	} else {
+		delete(s.devices, dc.Identifier)
+	}
+	s.mu.Unlock()
+
+	if was != connected {
+		s.publishConnected()
+	}
+}
+
+// Report an error to HA, as the bridge's last error
+func (s *Bridge) ReportError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.lastErrorMsg = err.Error()
+	s.lastErrorAt = time.Now()
+	s.mu.Unlock()
+
+	s.publishLastError()
+}
+
+func (s *Bridge) sensors() []*comms.Sensor {
+	return []*comms.Sensor{&s.version, &s.uptime, &s.connected, &s.lastError, &s.reconnects}
+}
+
+func (s *Bridge) publish(uptime time.Duration) {
+	mqtt := s.ha.mqtt
+	mqtt.PublishValue(&s.version, s.device.Version)
+	mqtt.PublishValue(&s.uptime, strconv.Itoa(int(uptime/time.Second)))
+	mqtt.PublishValue(&s.reconnects, strconv.Itoa(mqtt.Reconnects()))
+	s.publishConnected()
+	s.publishLastError()
+}
+
+func (s *Bridge) publishConnected() {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.devices))
+	for _, name := range s.devices {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+
+	s.ha.mqtt.PublishValue(&s.connected, strconv.Itoa(len(names)))
+	s.ha.mqtt.PublishAttributes(&s.connected, map[string]interface{}{"devices": names})
+}
+
+func (s *Bridge) publishLastError() {
+	s.mu.Lock()
+	msg, at := s.lastErrorMsg, s.lastErrorAt
+	s.mu.Unlock()
+
+	if at.IsZero() {
+		s.ha.mqtt.PublishValue(&s.lastError, "none")
+		return
+	}
+	state := msg
+	if len(state) > maxStateLength {
+		state = state[:maxStateLength-3] + "..."
+	}
+	s.ha.mqtt.PublishValue(&s.lastError, state)
+	s.ha.mqtt.PublishAttributes(&s.lastError, map[string]interface{}{
+		"error": msg,
+		"time":  at.Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,61 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"errors"
+	"ha-adapters/pkg/comms"
+	"ha-adapters/pkg/comms/mqtttest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBridge(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	require.NoError(t, err)
+	defer broker.Close()
+	client, err := comms.NewMqtt(broker.URI(), "", "")
+	require.NoError(t, err)
+	defer client.Close()
+
+	ha, _ := NewHomeAssistant(client)
+	bridge := NewBridge(ha, "ad410", "1.2.3")
+	defer bridge.Close()
+
+	// The bridge is the via_device, so isn't via anything itself
+	m, ok := broker.Retained("homeassistant/sensor/ha-adapters-ha-adapters/version/config")
+	require.True(t, ok)
+	var config map[string]interface{}
+	require.NoError(t, json.Unmarshal(m.Payload, &config))
+	device := config["device"].(map[string]interface{})
+	assert.Equal(t, "ha-adapters", device["identifiers"])
+	assert.NotContains(t, device, "via_device")
+
+	_, err = broker.WaitFor("ha-adapters/ha-adapters/version", 1, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3", string(broker.PublishedTo("ha-adapters/ha-adapters/version")[0].Payload))
+
+	// Uptime in seconds, as a duration
+	m, ok = broker.Retained("homeassistant/sensor/ha-adapters-ha-adapters/uptime/config")
+	require.True(t, ok)
+	require.NoError(t, json.Unmarshal(m.Payload, &config))
+	assert.Equal(t, "duration", config["device_class"])
+	assert.Equal(t, "s", config["unit_of_measurement"])
+	msgs, err := broker.WaitFor("ha-adapters/ha-adapters/uptime", 1, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "0", string(msgs[0].Payload))
+
+	bridge.DeviceConnected(testDevice, true)
+	msgs, err = broker.WaitFor("ha-adapters/ha-adapters/connected_devices/attributes", 2, time.Second)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"devices": ["Doorbell"]}`, string(msgs[1].Payload))
+	states := broker.PublishedTo("ha-adapters/ha-adapters/connected_devices")
+	assert.Equal(t, "1", string(states[len(states)-1].Payload))
+
+	bridge.ReportError(errors.New("kaboom"))
+	msgs, err = broker.WaitFor("ha-adapters/ha-adapters/last_error", 2, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "kaboom", string(msgs[1].Payload))
+}
@@ -3,21 +3,48 @@ package homeassistant
 import (
 	"fmt"
 	"ha-adapters/pkg/comms"
+	"ha-adapters/pkg/xlog"
 	"path"
+	"sync"
 
+	"github.com/sirupsen/logrus"
 	"golang.org/x/exp/maps"
 )
 
 var (
 	Default_HA_Root   = "homeassistant"
 	Default_HA_Prefix = "ha-adapters-"
-	Default_HA_Via    = "ha-adapters"
+	Default_HA_Via    = "ha-adapters" // Identifier of the `Bridge` device
+	Default_HA_Origin = Origin{Name: "ha-adapters"}
 )
 
+// Who published the discovery config, shown in HA's MQTT info
+type Origin struct {
+	Name    string
+	Version string
+	URL     string
+}
+
 type HomeAssistant struct {
 	mqtt        *comms.Mqtt
 	TopicRoot   string
 	TopicPrefix string
+	Origin      Origin
+
+	// Publish one device discovery payload per `DeviceClass`, with all its
+	// sensors as components, rather than a config topic per sensor. Each
+	// advertise or remove republishes the whole device
+	DeviceDiscovery bool
+
+	Log *logrus.Entry
+
+	mu      sync.Mutex
+	devices map[string]*discoveredDevice // Identifier ->
+}
+
+type discoveredDevice struct {
+	device     comms.DeviceClass
+	components map[string]JsonMap // Object id ->
 }
 
 func NewHomeAssistant(mqtt *comms.Mqtt) (*HomeAssistant, error) {
@@ -25,6 +52,9 @@ func NewHomeAssistant(mqtt *comms.Mqtt) (*HomeAssistant, error) {
 		mqtt:        mqtt,
 		TopicRoot:   Default_HA_Root,
 		TopicPrefix: Default_HA_Prefix,
+		Origin:      Default_HA_Origin,
+		Log:         xlog.Component("homeassistant"),
+		devices:     make(map[string]*discoveredDevice),
 	}
 
 	return ha, nil
@@ -35,33 +65,93 @@ func (s *HomeAssistant) Close() error {
 	return nil
 }
 
+// Publish discovery config for the sensor. Errors without publishing if the
+// type is unknown, its classes & unit don't go together, or it's missing
+// fields its platform requires
 func (s *HomeAssistant) Advertise(d *comms.Sensor) error {
-	topic := s.buildConfigTopic(d)
+	config, err := s.sensorConfig(d)
+	if err != nil {
+		return err
+	}
+
+	if s.DeviceDiscovery {
+		config["platform"] = d.Type
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		dev := s.deviceLocked(&d.DeviceClass)
+		dev.components[d.SanitizedName()] = config
+		return s.publishDeviceLocked(dev)
+	}
 
 	payload := s.deviceBaseConfig(&d.DeviceClass)
-	maps.Copy(payload, JsonMap{
-		"state_topic": d.StateTopic(),
-		"name":        d.FullName(),
-		"unique_id":   d.UniqueId(),
-	})
-
-	switch d.Type {
-	case comms.ST_BINARY_SENSOR:
-		maps.Copy(payload, JsonMap{
-			"payload_on":  comms.STATE_ON,
-			"payload_off": comms.STATE_OFF,
-		})
-	case comms.ST_SWITCH:
-		payload["command_topic"] = d.StateTopic()
-		payload["optimistic"] = true
-	case comms.ST_SENSOR:
-		payload["unit_of_measurement"] = d.UnitOfMeasurement
+	maps.Copy(payload, config)
+
+	// Publish!
+	return s.mqtt.RetainJson(s.buildConfigTopic(d), payload)
+}
+
+// Remove the sensor from HA
+func (s *HomeAssistant) Remove(d *comms.Sensor) error {
+	if !s.DeviceDiscovery {
+		return s.mqtt.ClearRetained(s.buildConfigTopic(d))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dev, ok := s.devices[d.Identifier]
+	if !ok {
+		return nil
+	}
+
+	// A component with only its platform removes it; after that it can be
+	// left out entirely
+	id := d.SanitizedName()
+	dev.components[id] = JsonMap{"platform": d.Type}
+	if err := s.publishDeviceLocked(dev); err != nil {
+		return err
+	}
+	delete(dev.components, id)
+
+	if len(dev.components) == 0 {
+		delete(s.devices, d.Identifier)
+		return s.mqtt.ClearRetained(s.buildDeviceConfigTopic(&dev.device))
+	}
+	return nil
+}
+
+// The sensor's own config, without the device or availability
+func (s *HomeAssistant) sensorConfig(d *comms.Sensor) (JsonMap, error) {
+	p, ok := platforms[d.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sensor type %q", d.Type)
+	}
+	if err := d.ValidateClasses(); err != nil {
+		return nil, err
+	}
+
+	payload := JsonMap{
+		"name":      d.FullName(),
+		"unique_id": d.UniqueId(),
+	}
+
+	if p.StateTopic {
+		payload["state_topic"] = d.StateTopic()
+	}
+	if p.Command {
+		payload["command_topic"] = d.CommandTopic()
+	}
+	if p.Fields != nil {
+		maps.Copy(payload, p.Fields(d))
 	}
 
 	// Optional classes
 	if d.ClassType != "" {
 		payload["device_class"] = d.ClassType
 	}
+	if d.StateClass != "" {
+		payload["state_class"] = d.StateClass
+	}
 	if d.Category != "" {
 		payload["entity_category"] = d.Category
 	}
@@ -71,14 +161,38 @@ func (s *HomeAssistant) Advertise(d *comms.Sensor) error {
 	if d.JsonPath != "" {
 		payload["value_template"] = fmt.Sprintf("{{ value_json%s }}", d.JsonPath)
 	}
+	if d.HasAttributes {
+		payload["json_attributes_topic"] = d.AttributesTopic()
+	}
 
 	// Misc
 	if d.Extra != nil {
 		maps.Copy(payload, d.Extra)
 	}
 
-	// Publish!
-	return s.mqtt.RetainJson(topic, payload)
+	if err := validateRequired(d, p, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Must hold lock
+func (s *HomeAssistant) deviceLocked(dc *comms.DeviceClass) *discoveredDevice {
+	dev, ok := s.devices[dc.Identifier]
+	if !ok {
+		dev = &discoveredDevice{components: make(map[string]JsonMap)}
+		s.devices[dc.Identifier] = dev
+	}
+	dev.device = *dc
+	return dev
+}
+
+// Publish the device with all its components. Must hold lock, so the last
+// publish always has the latest components
+func (s *HomeAssistant) publishDeviceLocked(dev *discoveredDevice) error {
+	payload := s.deviceBaseConfig(&dev.device)
+	payload["components"] = dev.components
+	return s.mqtt.RetainJson(s.buildDeviceConfigTopic(&dev.device), payload)
 }
 
 func (s *HomeAssistant) buildConfigTopic(d *comms.Sensor) string {
@@ -91,17 +205,43 @@ func (s *HomeAssistant) buildConfigTopic(d *comms.Sensor) string {
 		"config")
 }
 
+func (s *HomeAssistant) buildDeviceConfigTopic(dc *comms.DeviceClass) string {
+	// "{{.HA.TopicRoot}}/device/{{.HA.TopicPrefix}}{{.Dev.Identifier}}/config"
+	return path.Join(
+		s.TopicRoot,
+		"device",
+		s.TopicPrefix+dc.Identifier,
+		"config")
+}
+
 func (s *HomeAssistant) deviceBaseConfig(dc *comms.DeviceClass) JsonMap {
-	return JsonMap{
+	device := JsonMap{
+		"name":         dc.DeviceName,
+		"manufacturer": dc.Manufacturer,
+		"model":        dc.Model,
+		"identifiers":  dc.Identifier,
+		"sw_version":   dc.Version,
+	}
+	// Everything hangs off the bridge, except the bridge itself
+	if dc.Identifier != Default_HA_Via {
+		device["via_device"] = Default_HA_Via
+	}
+
+	ret := JsonMap{
 		"availability_topic": comms.TopicStatus,
 		"qos":                s.mqtt.Qos,
-		"device": JsonMap{
-			"name":         dc.DeviceName,
-			"manufacturer": dc.Manufacturer,
-			"model":        dc.Model,
-			"identifiers":  dc.Identifier,
-			"sw_version":   dc.Version,
-			"via_device":   Default_HA_Via,
-		},
+		"device":             device,
+	}
+
+	if s.Origin.Name != "" {
+		origin := JsonMap{"name": s.Origin.Name}
+		if s.Origin.Version != "" {
+			origin["sw_version"] = s.Origin.Version
+		}
+		if s.Origin.URL != "" {
+			origin["support_url"] = s.Origin.URL
+		}
+		ret["origin"] = origin
 	}
+	return ret
 }
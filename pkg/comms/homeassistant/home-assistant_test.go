@@ -0,0 +1,209 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"ha-adapters/pkg/comms"
+	"ha-adapters/pkg/comms/mqtttest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func advertiseTest(t *testing.T, sensor *comms.Sensor) (topic string, payload map[string]interface{}) {
+	broker, err := mqtttest.NewBroker()
+	require.NoError(t, err)
+	t.Cleanup(func() { broker.Close() })
+
+	client, err := comms.NewMqtt(broker.URI(), "", "")
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	ha, _ := NewHomeAssistant(client)
+	require.NoError(t, ha.Advertise(sensor))
+
+	msgs := broker.PublishedTo("homeassistant/#")
+	require.Len(t, msgs, 1)
+	assert.True(t, msgs[0].Retain)
+	require.NoError(t, json.Unmarshal(msgs[0].Payload, &payload))
+	return msgs[0].Topic, payload
+}
+
+var testDevice = comms.DeviceClass{
+	DeviceName:   "Doorbell",
+	Manufacturer: "Amcrest",
+	Model:        "AD410",
+	Identifier:   "SN1",
+	Version:      "1.0",
+}
+
+func TestAdvertiseBinarySensor(t *testing.T) {
+	topic, payload := advertiseTest(t, &comms.Sensor{
+		DeviceClass: testDevice,
+		Name:        "Motion",
+		Type:        comms.ST_BINARY_SENSOR,
+		ClassType:   comms.SC_MOTION,
+
+		HasAttributes: true,
+	})
+
+	assert.Equal(t, "homeassistant/binary_sensor/ha-adapters-SN1/motion/config", topic)
+	assert.Equal(t, "ha-adapters/sn1/motion", payload["state_topic"])
+	assert.Equal(t, "Doorbell Motion", payload["name"])
+	assert.Equal(t, "sn1.motion", payload["unique_id"])
+	assert.Equal(t, "on", payload["payload_on"])
+	assert.Equal(t, "motion", payload["device_class"])
+	assert.Equal(t, comms.TopicStatus, payload["availability_topic"])
+	assert.NotContains(t, payload, "unit_of_measurement")
+	assert.Equal(t, "ha-adapters/sn1/motion/attributes", payload["json_attributes_topic"])
+
+	device := payload["device"].(map[string]interface{})
+	assert.Equal(t, "SN1", device["identifiers"])
+	assert.Equal(t, "Amcrest", device["manufacturer"])
+}
+
+func TestAdvertiseSwitch(t *testing.T) {
+	_, payload := advertiseTest(t, &comms.Sensor{
+		DeviceClass: testDevice,
+		Name:        "Light",
+		Type:        comms.ST_SWITCH,
+		Category:    comms.EC_CONFIG,
+	})
+
+	assert.Equal(t, "ha-adapters/sn1/light", payload["command_topic"])
+	assert.Equal(t, true, payload["optimistic"])
+	assert.Equal(t, "config", payload["entity_category"])
+	assert.NotContains(t, payload, "json_attributes_topic")
+}
+
+func TestAdvertisePlatforms(t *testing.T) {
+	tests := []struct {
+		sensor   comms.Sensor
+		has      []string
+		hasNoKey string
+	}{
+		{comms.Sensor{Type: comms.ST_BUTTON}, []string{"command_topic"}, "state_topic"},
+		{comms.Sensor{Type: comms.ST_NUMBER, UnitOfMeasurement: "s", Extra: map[string]interface{}{"min": 0, "max": 60}}, []string{"command_topic", "state_topic", "unit_of_measurement", "min", "max"}, ""},
+		{comms.Sensor{Type: comms.ST_SELECT, Options: []string{"a", "b"}}, []string{"command_topic", "options"}, ""},
+		{comms.Sensor{Type: comms.ST_TEXT}, []string{"command_topic", "state_topic"}, ""},
+		{comms.Sensor{Type: comms.ST_LIGHT}, []string{"command_topic", "payload_on"}, ""},
+		{comms.Sensor{Type: comms.ST_SIREN}, []string{"command_topic", "state_on"}, ""},
+		{comms.Sensor{Type: comms.ST_LOCK}, []string{"command_topic"}, ""},
+		{comms.Sensor{Type: comms.ST_CAMERA}, []string{"topic"}, "state_topic"},
+		{comms.Sensor{Type: comms.ST_IMAGE}, []string{"image_topic"}, "state_topic"},
+		{comms.Sensor{Type: comms.ST_EVENT, Options: []string{"press"}}, []string{"state_topic", "event_types"}, ""},
+		{comms.Sensor{Type: comms.ST_UPDATE}, []string{"state_topic"}, ""},
+		{comms.Sensor{Type: comms.ST_DEVICE_TRACKER}, []string{"state_topic"}, ""},
+		{comms.Sensor{Type: comms.ST_SCENE}, []string{"command_topic"}, "state_topic"},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.sensor.Type), func(t *testing.T) {
+			test.sensor.DeviceClass = testDevice
+			test.sensor.Name = "Thing"
+			topic, payload := advertiseTest(t, &test.sensor)
+
+			assert.Equal(t, "homeassistant/"+string(test.sensor.Type)+"/ha-adapters-SN1/thing/config", topic)
+			for _, key := range test.has {
+				assert.Contains(t, payload, key)
+			}
+			if test.hasNoKey != "" {
+				assert.NotContains(t, payload, test.hasNoKey)
+			}
+		})
+	}
+}
+
+func TestAdvertiseInvalid(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	require.NoError(t, err)
+	defer broker.Close()
+	client, err := comms.NewMqtt(broker.URI(), "", "")
+	require.NoError(t, err)
+	defer client.Close()
+	ha, _ := NewHomeAssistant(client)
+
+	// Only what the caller has to give is required; topics and names are filled in
+	err = ha.Advertise(&comms.Sensor{DeviceClass: testDevice, Name: "Mode", Type: comms.ST_SELECT})
+	assert.EqualError(t, err, `select "Mode": missing required options`)
+	err = ha.Advertise(&comms.Sensor{DeviceClass: testDevice, Name: "Press", Type: comms.ST_EVENT})
+	assert.EqualError(t, err, `event "Press": missing required event_types`)
+	err = ha.Advertise(&comms.Sensor{DeviceClass: testDevice, Name: "Delay", Type: comms.ST_NUMBER, Extra: map[string]interface{}{"min": 0}})
+	assert.EqualError(t, err, `number "Delay": missing required max`)
+
+	err = ha.Advertise(&comms.Sensor{DeviceClass: testDevice, Name: "X", Type: "vacuum"})
+	assert.EqualError(t, err, `unsupported sensor type "vacuum"`)
+
+	assert.Empty(t, broker.PublishedTo("homeassistant/#"))
+}
+
+func TestAdvertiseStateClass(t *testing.T) {
+	_, payload := advertiseTest(t, &comms.Sensor{
+		DeviceClass:       testDevice,
+		Name:              "Storage Used",
+		Type:              comms.ST_SENSOR,
+		UnitOfMeasurement: comms.UNIT_GIGABYTES,
+		ClassType:         comms.SC_DATA_SIZE,
+		StateClass:        comms.STATE_CLASS_MEASUREMENT,
+	})
+
+	assert.Equal(t, "data_size", payload["device_class"])
+	assert.Equal(t, "measurement", payload["state_class"])
+	assert.Equal(t, "GB", payload["unit_of_measurement"])
+}
+
+func TestDeviceDiscovery(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	require.NoError(t, err)
+	defer broker.Close()
+	client, err := comms.NewMqtt(broker.URI(), "", "")
+	require.NoError(t, err)
+	defer client.Close()
+
+	ha, _ := NewHomeAssistant(client)
+	ha.DeviceDiscovery = true
+
+	motion := &comms.Sensor{DeviceClass: testDevice, Name: "Motion", Type: comms.ST_BINARY_SENSOR, ClassType: comms.SC_MOTION}
+	light := &comms.Sensor{DeviceClass: testDevice, Name: "Light", Type: comms.ST_SWITCH}
+	require.NoError(t, ha.Advertise(motion))
+	require.NoError(t, ha.Advertise(light))
+
+	const topic = "homeassistant/device/ha-adapters-SN1/config"
+	retained := func() (payload map[string]interface{}) {
+		m, ok := broker.Retained(topic)
+		require.True(t, ok)
+		require.NoError(t, json.Unmarshal(m.Payload, &payload))
+		return
+	}
+
+	// Only the device topic, with both sensors as components
+	assert.Len(t, broker.PublishedTo("homeassistant/#"), 2)
+	assert.Empty(t, broker.PublishedTo("homeassistant/binary_sensor/#"))
+
+	payload := retained()
+	assert.Equal(t, "ha-adapters", payload["origin"].(map[string]interface{})["name"])
+	assert.Equal(t, "SN1", payload["device"].(map[string]interface{})["identifiers"])
+	assert.Equal(t, "ha-adapters/status", payload["availability_topic"])
+
+	components := payload["components"].(map[string]interface{})
+	require.Len(t, components, 2)
+	assert.Equal(t, "binary_sensor", components["motion"].(map[string]interface{})["platform"])
+	assert.Equal(t, "motion", components["motion"].(map[string]interface{})["device_class"])
+	assert.Equal(t, "sn1.motion", components["motion"].(map[string]interface{})["unique_id"])
+	assert.Equal(t, "switch", components["light"].(map[string]interface{})["platform"])
+
+	// Removing leaves just the platform, once
+	require.NoError(t, ha.Remove(light))
+	components = retained()["components"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"platform": "switch"}, components["light"])
+
+	require.NoError(t, ha.Advertise(motion))
+	components = retained()["components"].(map[string]interface{})
+	assert.Len(t, components, 1)
+	assert.Contains(t, components, "motion")
+
+	// Last one out clears the device
+	require.NoError(t, ha.Remove(motion))
+	_, ok := broker.Retained(topic)
+	assert.False(t, ok)
+}
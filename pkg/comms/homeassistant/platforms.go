@@ -0,0 +1,150 @@
+package homeassistant
+
+import (
+	"fmt"
+	"ha-adapters/pkg/comms"
+)
+
+// What each HA MQTT platform's discovery config looks like
+type platform struct {
+	StateTopic bool                          // Has a `state_topic`
+	Command    bool                          // Takes commands on `command_topic`
+	Fields     func(d *comms.Sensor) JsonMap // Platform specific fields, optional
+	Required   []string                      // Config only the caller can give, via `Options` or `Extra`
+}
+
+func onOffFields(d *comms.Sensor) JsonMap {
+	return JsonMap{
+		"payload_on":  comms.STATE_ON,
+		"payload_off": comms.STATE_OFF,
+	}
+}
+
+func optionsField(key string) func(d *comms.Sensor) JsonMap {
+	return func(d *comms.Sensor) JsonMap {
+		if len(d.Options) == 0 {
+			return nil
+		}
+		return JsonMap{key: d.Options}
+	}
+}
+
+var platforms = map[comms.SensorType]platform{
+	comms.ST_BINARY_SENSOR: {
+		StateTopic: true,
+		Fields:     onOffFields,
+	},
+	comms.ST_SENSOR: {
+		StateTopic: true,
+		Fields: func(d *comms.Sensor) JsonMap {
+			if d.UnitOfMeasurement == "" {
+				return nil
+			}
+			return JsonMap{"unit_of_measurement": d.UnitOfMeasurement}
+		},
+	},
+	comms.ST_SWITCH: {
+		// Commands on the state topic, so HA's state is optimistic
+		StateTopic: true,
+		Fields: func(d *comms.Sensor) JsonMap {
+			return JsonMap{
+				"command_topic": d.StateTopic(),
+				"optimistic":    true,
+			}
+		},
+	},
+	comms.ST_BUTTON: {
+		Command: true,
+	},
+	comms.ST_NUMBER: {
+		StateTopic: true,
+		Command:    true,
+		Fields: func(d *comms.Sensor) JsonMap {
+			if d.UnitOfMeasurement == "" {
+				return nil
+			}
+			return JsonMap{"unit_of_measurement": d.UnitOfMeasurement}
+		},
+		// HA's defaults of 1-100 are rarely what's meant
+		Required: []string{"min", "max"},
+	},
+	comms.ST_SELECT: {
+		StateTopic: true,
+		Command:    true,
+		Fields:     optionsField("options"),
+		Required:   []string{"options"},
+	},
+	comms.ST_TEXT: {
+		StateTopic: true,
+		Command:    true,
+	},
+	comms.ST_LIGHT: {
+		StateTopic: true,
+		Command:    true,
+		Fields:     onOffFields,
+	},
+	comms.ST_SIREN: {
+		StateTopic: true,
+		Command:    true,
+		Fields: func(d *comms.Sensor) JsonMap {
+			return JsonMap{
+				"payload_on":  comms.STATE_ON,
+				"payload_off": comms.STATE_OFF,
+				"state_on":    comms.STATE_ON,
+				"state_off":   comms.STATE_OFF,
+			}
+		},
+	},
+	comms.ST_LOCK: {
+		StateTopic: true,
+		Command:    true,
+	},
+	comms.ST_CAMERA: {
+		// Raw image bytes, published to the state topic
+		Fields: func(d *comms.Sensor) JsonMap {
+			return JsonMap{"topic": d.StateTopic()}
+		},
+	},
+	comms.ST_IMAGE: {
+		Fields: func(d *comms.Sensor) JsonMap {
+			return JsonMap{"image_topic": d.StateTopic()}
+		},
+	},
+	comms.ST_EVENT: {
+		StateTopic: true,
+		Fields:     optionsField("event_types"),
+		Required:   []string{"event_types"},
+	},
+	comms.ST_UPDATE: {
+		StateTopic: true,
+	},
+	comms.ST_DEVICE_TRACKER: {
+		StateTopic: true,
+	},
+	comms.ST_SCENE: {
+		Command: true,
+	},
+}
+
+func validateRequired(d *comms.Sensor, p platform, payload JsonMap) error {
+	for _, key := range p.Required {
+		if isEmpty(payload[key]) {
+			return fmt.Errorf("%s %q: missing required %s", d.Type, d.Name, key)
+		}
+	}
+	return nil
+}
+
+func isEmpty(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []string:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
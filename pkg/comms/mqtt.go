@@ -3,6 +3,10 @@ package comms
 import (
 	"encoding/json"
 	"errors"
+	"ha-adapters/pkg/metrics"
+	"ha-adapters/pkg/xlog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -18,12 +22,26 @@ type Mqtt struct {
 	mqtt mqtt.Client
 	Qos  byte
 
-	storedSubs   map[string]func(mqtt.Message) // topic -> msg handler
+	subsMu       sync.Mutex
+	storedSubs   map[string]*orderedDelivery // topic -> msg handler
 	loopShutdown chan<- struct{}
+	queue        *orderedQueue // State publishes, ordered per topic
+	connects     int32         // atomic
+
+	Log *logrus.Entry
 }
 
 var _ Publisher = &Mqtt{}
 
+var (
+	metricPublishes = metrics.NewCounter("mqtt_publishes_total",
+		"MQTT publishes, by result (ok or error)", "result")
+	metricPublishDuration = metrics.NewHistogram("mqtt_publish_duration_seconds",
+		"Time for the broker to acknowledge a publish", nil)
+	metricReconnects = metrics.NewCounter("mqtt_reconnects_total",
+		"Reconnects to the broker")
+)
+
 func NewMqtt(brokerUri string, username, password string) (*Mqtt, error) {
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(brokerUri)
@@ -34,10 +52,16 @@ func NewMqtt(brokerUri string, username, password string) (*Mqtt, error) {
 
 	client := &Mqtt{
 		Qos:        2,
-		storedSubs: make(map[string]func(mqtt.Message)),
+		storedSubs: make(map[string]*orderedDelivery),
+		queue:      newOrderedQueue(4, 100),
+		Log:        xlog.Component("mqtt").WithField("broker", brokerUri),
 	}
 
 	opts.OnConnect = func(c mqtt.Client) {
+		if atomic.AddInt32(&client.connects, 1) > 1 {
+			client.Log.Info("Reconnected to MQTT")
+			metricReconnects.With().Inc()
+		}
 		client.resubscribe()
 	}
 
@@ -48,19 +72,20 @@ func NewMqtt(brokerUri string, username, password string) (*Mqtt, error) {
 	// NewClient makes a copy of `opts`
 	client.mqtt = mqtt.NewClient(opts)
 
-	logrus.Infof("Connecting to %s...", brokerUri)
+	client.Log.Info("Connecting...")
 	if err := resolveToken(client.mqtt.Connect()); err != nil {
 		return nil, err
 	}
 
 	client.loopShutdown = client.startOnlineLoop(1 * time.Minute)
 
-	logrus.Info("Connected!")
+	client.Log.Info("Connected!")
 
 	return client, nil
 }
 
 func (s *Mqtt) Close() error {
+	s.queue.Close()
 	if s.loopShutdown != nil {
 		s.loopShutdown <- struct{}{}
 		s.loopShutdown = nil
@@ -68,16 +93,43 @@ func (s *Mqtt) Close() error {
 		s.PublishString(TopicStatus, STATUS_OFFLINE)
 	}
 	s.mqtt.Disconnect(1000)
+
+	// Ends each subscription's delivery goroutine
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	for topic, sub := range s.storedSubs {
+		sub.Close()
+		delete(s.storedSubs, topic)
+	}
 	return nil
 }
 
+// Whether currently connected to the broker; false while reconnecting
+func (s *Mqtt) IsConnected() bool {
+	return s.mqtt.IsConnectionOpen()
+}
+
+// Times the client has reconnected to the broker since first connecting
+func (s *Mqtt) Reconnects() int {
+	if n := atomic.LoadInt32(&s.connects); n > 1 {
+		return int(n - 1)
+	}
+	return 0
+}
+
 // Publish a topic with a string or []byte payload
 func (s *Mqtt) publish(topic string, retain bool, payload []byte) error {
-	logrus.Tracef("Publishing on %s: %s", topic, payload)
+	log := s.Log.WithField("topic", topic)
+	log.Tracef("Publishing: %s", payload)
+	start := time.Now()
 	ret := s.mqtt.Publish(topic, s.Qos, retain, payload)
 	err := resolveToken(ret)
+	metricPublishDuration.With().ObserveSince(start)
 	if err != nil {
-		logrus.Warnf("Error publishing to %s: %s", topic, err)
+		metricPublishes.With("error").Inc()
+		log.Warnf("Error publishing: %s", err)
+	} else {
+		metricPublishes.With("ok").Inc()
 	}
 	return err
 }
@@ -106,12 +158,36 @@ func (s *Mqtt) RetainJson(topic string, data interface{}) error {
 	return s.publish(topic, true, b)
 }
 
+// Remove a retained message from the broker
+func (s *Mqtt) ClearRetained(topic string) error {
+	return s.publish(topic, true, nil)
+}
+
+// Queue a state publish without waiting on the broker. Publishes to the same
+// topic go out in the order queued
 func (s *Mqtt) PublishState(device SensorTopic, state SensorState) {
-	s.PublishString(device.StateTopic(), string(state))
+	s.PublishValue(device, string(state))
 }
 
 func (s *Mqtt) PublishValue(device SensorTopic, value string) {
-	s.PublishString(device.StateTopic(), value)
+	topic := device.StateTopic()
+	s.queue.Enqueue(topic, func() {
+		s.PublishString(topic, value)
+	})
+}
+
+// Queue a publish of the sensor's JSON attributes. Ordered with its state, so
+// attributes queued first arrive before the state they describe
+func (s *Mqtt) PublishAttributes(device SensorAttributesTopic, attributes map[string]interface{}) {
+	topic := device.AttributesTopic()
+	s.queue.Enqueue(device.StateTopic(), func() {
+		s.PublishJson(topic, attributes)
+	})
+}
+
+// Wait for queued state publishes to be sent
+func (s *Mqtt) Flush() {
+	s.queue.Flush()
 }
 
 func (s *Mqtt) Subscribe(topic string) (events <-chan mqtt.Message, err error) {
@@ -129,27 +205,45 @@ func (s *Mqtt) SubscribeFunc(topic string, f func(topic, val string)) error {
 	})
 }
 
+// Each subscription's messages are handled in order, on its own goroutine
 func (s *Mqtt) subscribeStore(topic string, f func(m mqtt.Message)) error {
-	if err := s.subscribeInternal(topic, f); err != nil {
+	sub := newOrderedDelivery(100, f)
+	if err := s.subscribeInternal(topic, sub.Deliver); err != nil {
+		sub.Close()
 		return err
 	}
-	s.storedSubs[topic] = f
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	// The broker only keeps the newest handler for a topic
+	if prev := s.storedSubs[topic]; prev != nil {
+		prev.Close()
+	}
+	s.storedSubs[topic] = sub
 	return nil
 }
 
+// Called by paho on (re)connect, possibly while subscribing
 func (s *Mqtt) resubscribe() {
-	for topic, f := range s.storedSubs {
-		s.subscribeInternal(topic, f)
+	s.subsMu.Lock()
+	subs := make(map[string]*orderedDelivery, len(s.storedSubs))
+	for topic, sub := range s.storedSubs {
+		subs[topic] = sub
+	}
+	s.subsMu.Unlock()
+
+	for topic, sub := range subs {
+		s.subscribeInternal(topic, sub.Deliver)
 	}
 }
 
 func (s *Mqtt) subscribeInternal(topic string, f func(m mqtt.Message)) error {
-	logrus.Debugf("Subscribing to %s...", topic)
+	log := s.Log.WithField("topic", topic)
+	log.Debug("Subscribing...")
 	t := s.mqtt.Subscribe(topic, 0, func(c mqtt.Client, m mqtt.Message) {
-		go f(m)
+		f(m)
 	})
 	if err := resolveToken(t); err != nil {
-		logrus.Warnf("Error subscribing to %s: %s", topic, err)
+		log.Warnf("Error subscribing: %s", err)
 		return err
 	}
 	return nil
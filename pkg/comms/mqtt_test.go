@@ -1,10 +1,15 @@
 package comms
 
 import (
+	"ha-adapters/pkg/comms/mqtttest"
 	"path"
+	"strconv"
 	"testing"
+	"time"
 
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPathCombineAssumption(t *testing.T) {
@@ -12,3 +17,170 @@ func TestPathCombineAssumption(t *testing.T) {
 	assert.Equal(t, "abc/efg", path.Join("abc", "/efg"))
 	assert.Equal(t, "abc/efg", path.Join("abc/", "/efg"))
 }
+
+func connectTest(t *testing.T) (*mqtttest.Broker, *Mqtt) {
+	broker, err := mqtttest.NewBroker()
+	require.NoError(t, err)
+	t.Cleanup(func() { broker.Close() })
+
+	client, err := NewMqtt(broker.URI(), "", "")
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return broker, client
+}
+
+func TestOnlineAndWill(t *testing.T) {
+	broker, _ := connectTest(t)
+
+	msgs, err := broker.WaitFor(TopicStatus, 1, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, STATUS_ONLINE, string(msgs[0].Payload))
+	assert.False(t, msgs[0].Will)
+
+	broker.DropClients()
+	msgs, err = broker.WaitFor(TopicStatus, 2, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, STATUS_OFFLINE, string(msgs[1].Payload))
+	assert.True(t, msgs[1].Will)
+}
+
+func TestPublishFlags(t *testing.T) {
+	broker, client := connectTest(t)
+	sensor := &Sensor{DeviceClass: DeviceClass{Identifier: "SN1"}, Name: "Motion"}
+
+	client.PublishState(sensor, STATE_ON)
+	client.Flush()
+	require.NoError(t, client.RetainJson("ha-adapters/sn1/config", map[string]string{"a": "b"}))
+
+	msgs, err := broker.WaitFor("ha-adapters/sn1/#", 2, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "ha-adapters/sn1/motion", msgs[0].Topic)
+	assert.Equal(t, "on", string(msgs[0].Payload))
+	assert.Equal(t, byte(2), msgs[0].Qos)
+	assert.False(t, msgs[0].Retain)
+
+	retained, ok := broker.Retained("ha-adapters/sn1/config")
+	assert.True(t, ok)
+	assert.JSONEq(t, `{"a":"b"}`, string(retained.Payload))
+}
+
+func TestResubscribe(t *testing.T) {
+	broker, client := connectTest(t)
+
+	received := make(chan string, 10)
+	require.NoError(t, client.SubscribeFunc("test/+/set", func(topic, val string) {
+		received <- topic + "=" + val
+	}))
+
+	broker.Publish("test/light/set", []byte("on"), false)
+	assert.Equal(t, "test/light/set=on", <-received)
+
+	// Drop & wait for the client to reconnect and resubscribe
+	broker.DropClients()
+	require.NoError(t, broker.WaitForSubscription("test/+/set", 1, 5*time.Second))
+	assert.Equal(t, 2, broker.Connects())
+	assert.Equal(t, 1, client.Reconnects())
+
+	broker.Publish("test/light/set", []byte("off"), false)
+	select {
+	case got := <-received:
+		assert.Equal(t, "test/light/set=off", got)
+	case <-time.After(time.Second):
+		t.Fatal("no message after resubscribe")
+	}
+}
+
+func TestOrderedStatePublish(t *testing.T) {
+	broker, client := connectTest(t)
+	sensor := &Sensor{DeviceClass: DeviceClass{Identifier: "SN1"}, Name: "Motion"}
+
+	for i := 0; i < 50; i++ {
+		client.PublishState(sensor, StateStr(i%2 == 0))
+	}
+	client.Flush()
+
+	msgs := broker.PublishedTo(sensor.StateTopic())
+	require.Len(t, msgs, 50)
+	for i, m := range msgs {
+		assert.Equal(t, string(StateStr(i%2 == 0)), string(m.Payload))
+	}
+}
+
+func TestOrderedSubscription(t *testing.T) {
+	broker, client := connectTest(t)
+
+	received := make(chan string, 100)
+	require.NoError(t, client.SubscribeFunc("test/seq", func(topic, val string) {
+		time.Sleep(time.Millisecond) // Slow handler mustn't reorder
+		received <- val
+	}))
+
+	for i := 0; i < 20; i++ {
+		broker.Publish("test/seq", []byte(strconv.Itoa(i)), false)
+	}
+	for i := 0; i < 20; i++ {
+		select {
+		case got := <-received:
+			assert.Equal(t, strconv.Itoa(i), got)
+		case <-time.After(time.Second):
+			t.Fatal("missing message")
+		}
+	}
+}
+
+func TestOrderedDeliveryClose(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan struct{}, 10)
+	sub := newOrderedDelivery(1, func(mqtt.Message) {
+		<-release
+		handled <- struct{}{}
+	})
+
+	// One being handled, one buffered, and one stuck waiting for room
+	sub.Deliver(nil)
+	sub.Deliver(nil)
+	stuck := make(chan struct{})
+	go func() {
+		sub.Deliver(nil)
+		close(stuck)
+	}()
+
+	sub.Close()
+	select {
+	case <-stuck:
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't unblock Deliver")
+	}
+	sub.Deliver(nil)
+	sub.Close()
+
+	// What was accepted is still handled, then nothing more
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("missing message")
+		}
+	}
+	select {
+	case <-handled:
+		t.Fatal("message handled after Close")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPublishAttributes(t *testing.T) {
+	broker, client := connectTest(t)
+	sensor := &Sensor{DeviceClass: DeviceClass{Identifier: "SN1"}, Name: "Motion", HasAttributes: true}
+
+	client.PublishAttributes(sensor, map[string]interface{}{"index": 1})
+	client.PublishState(sensor, STATE_ON)
+	client.Flush()
+
+	msgs := broker.PublishedTo("ha-adapters/sn1/motion/#")
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "ha-adapters/sn1/motion/attributes", msgs[0].Topic)
+	assert.JSONEq(t, `{"index":1}`, string(msgs[0].Payload))
+	assert.Equal(t, "ha-adapters/sn1/motion", msgs[1].Topic)
+}
@@ -0,0 +1,513 @@
+package mqtttest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A minimal in-process MQTT 3.1.1 broker for tests. It records every publish
+(with its QoS & retain flags), routes to subscribers, keeps retained
+messages, and publishes a client's last-will when its connection drops.
+Delivery to subscribers is always QoS 0
+*/
+
+type Message struct {
+	ClientID string
+	Topic    string
+	Payload  []byte
+	Qos      byte
+	Retain   bool
+	Will     bool // Published by the broker on behalf of a dropped client
+}
+
+type Broker struct {
+	ln net.Listener
+
+	mu        sync.Mutex
+	clients   map[*conn]struct{}
+	published []Message
+	retained  map[string]Message
+	changed   chan struct{} // Closed & replaced on any change
+	connects  int
+}
+
+type conn struct {
+	net.Conn
+	broker *Broker
+
+	writeMu sync.Mutex
+
+	clientID string
+	will     *Message
+	subs     map[string]struct{}
+}
+
+const (
+	pktConnect     = 1
+	pktConnack     = 2
+	pktPublish     = 3
+	pktPuback      = 4
+	pktPubrec      = 5
+	pktPubrel      = 6
+	pktPubcomp     = 7
+	pktSubscribe   = 8
+	pktSuback      = 9
+	pktUnsubscribe = 10
+	pktUnsuback    = 11
+	pktPingreq     = 12
+	pktPingresp    = 13
+	pktDisconnect  = 14
+)
+
+func NewBroker() (*Broker, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Broker{
+		ln:       ln,
+		clients:  make(map[*conn]struct{}),
+		retained: make(map[string]Message),
+		changed:  make(chan struct{}),
+	}
+	go b.acceptLoop()
+	return b, nil
+}
+
+// Broker address, for `comms.NewMqtt`
+func (s *Broker) URI() string {
+	return "tcp://" + s.ln.Addr().String()
+}
+
+func (s *Broker) Close() error {
+	err := s.ln.Close()
+	s.DropClients()
+	return err
+}
+
+// Every message published, in order received
+func (s *Broker) Published() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.published...)
+}
+
+// Messages published on topics matching `filter` (which may have wildcards)
+func (s *Broker) PublishedTo(filter string) (ret []Message) {
+	for _, m := range s.Published() {
+		if TopicMatches(filter, m.Topic) {
+			ret = append(ret, m)
+		}
+	}
+	return
+}
+
+func (s *Broker) Retained(topic string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.retained[topic]
+	return m, ok
+}
+
+// Block until at least `n` messages matching `filter` have been published, returning them
+func (s *Broker) WaitFor(filter string, n int, timeout time.Duration) ([]Message, error) {
+	return s.waitUntil(timeout, func() ([]Message, bool) {
+		msgs := s.PublishedTo(filter)
+		return msgs, len(msgs) >= n
+	})
+}
+
+// Block until there are `n` subscriptions matching `filter` exactly, across all clients
+func (s *Broker) WaitForSubscription(filter string, n int, timeout time.Duration) error {
+	_, err := s.waitUntil(timeout, func() ([]Message, bool) {
+		return nil, s.subscriptionCount(filter) >= n
+	})
+	return err
+}
+
+// Number of successful CONNECTs, including reconnects
+func (s *Broker) Connects() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connects
+}
+
+// Publish from the broker itself, as if another client had
+func (s *Broker) Publish(topic string, payload []byte, retain bool) {
+	s.route(Message{Topic: topic, Payload: payload, Retain: retain})
+}
+
+// Abruptly close every client connection; last-wills are published
+func (s *Broker) DropClients() {
+	s.mu.Lock()
+	conns := make([]*conn, 0, len(s.clients))
+	for c := range s.clients {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (s *Broker) waitUntil(timeout time.Duration, check func() ([]Message, bool)) ([]Message, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+
+		if msgs, ok := check(); ok {
+			return msgs, nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, errors.New("timed out")
+		}
+	}
+}
+
+func (s *Broker) subscriptionCount(filter string) (count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		if _, ok := c.subs[filter]; ok {
+			count++
+		}
+	}
+	return
+}
+
+// Must hold lock
+func (s *Broker) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Broker) acceptLoop() {
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{Conn: nc, broker: s, subs: make(map[string]struct{})}
+		go c.serve()
+	}
+}
+
+func (s *Broker) route(m Message) {
+	s.mu.Lock()
+	s.published = append(s.published, m)
+	if m.Retain {
+		if len(m.Payload) == 0 {
+			delete(s.retained, m.Topic)
+		} else {
+			s.retained[m.Topic] = m
+		}
+	}
+
+	var targets []*conn
+	for c := range s.clients {
+		for filter := range c.subs {
+			if TopicMatches(filter, m.Topic) {
+				targets = append(targets, c)
+				break
+			}
+		}
+	}
+	s.notifyLocked()
+	s.mu.Unlock()
+
+	for _, c := range targets {
+		c.writePublish(m.Topic, m.Payload, false)
+	}
+}
+
+func (s *conn) serve() {
+	defer s.disconnect(true)
+
+	r := bufio.NewReader(s.Conn)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case pktConnect:
+			if err := s.handleConnect(body); err != nil {
+				return
+			}
+		case pktPublish:
+			s.handlePublish(header, body)
+		case pktPubrel:
+			s.write(pktPubcomp<<4, body[:2])
+		case pktPuback, pktPubrec, pktPubcomp:
+			// We only deliver QoS 0
+		case pktSubscribe:
+			s.handleSubscribe(body)
+		case pktUnsubscribe:
+			s.handleUnsubscribe(body)
+		case pktPingreq:
+			s.write(pktPingresp<<4, nil)
+		case pktDisconnect:
+			s.disconnect(false)
+			return
+		default:
+			return
+		}
+	}
+}
+
+func (s *conn) handleConnect(body []byte) error {
+	r := &reader{b: body}
+	r.str() // protocol name
+	r.byte()
+	flags := r.byte()
+	r.u16() // keepalive
+	s.clientID = r.str()
+
+	if flags&0x04 != 0 {
+		s.will = &Message{
+			ClientID: s.clientID,
+			Topic:    r.str(),
+			Payload:  r.bytes(),
+			Qos:      (flags >> 3) & 0x03,
+			Retain:   flags&0x20 != 0,
+			Will:     true,
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	s.broker.mu.Lock()
+	s.broker.clients[s] = struct{}{}
+	s.broker.connects++
+	s.broker.notifyLocked()
+	s.broker.mu.Unlock()
+
+	s.write(pktConnack<<4, []byte{0, 0})
+	return nil
+}
+
+func (s *conn) handlePublish(header byte, body []byte) {
+	qos := (header >> 1) & 0x03
+	r := &reader{b: body}
+	topic := r.str()
+	var id []byte
+	if qos > 0 {
+		id = r.raw(2)
+	}
+	if r.err != nil {
+		return
+	}
+
+	s.broker.route(Message{
+		ClientID: s.clientID,
+		Topic:    topic,
+		Payload:  append([]byte(nil), r.b...),
+		Qos:      qos,
+		Retain:   header&0x01 != 0,
+	})
+
+	switch qos {
+	case 1:
+		s.write(pktPuback<<4, id)
+	case 2:
+		s.write(pktPubrec<<4, id)
+	}
+}
+
+func (s *conn) handleSubscribe(body []byte) {
+	r := &reader{b: body}
+	id := r.raw(2)
+
+	var filters []string
+	for len(r.b) > 0 && r.err == nil {
+		filters = append(filters, r.str())
+		r.byte() // requested qos
+	}
+	if r.err != nil {
+		return
+	}
+
+	s.broker.mu.Lock()
+	for _, f := range filters {
+		s.subs[f] = struct{}{}
+	}
+	var retained []Message
+	for topic, m := range s.broker.retained {
+		for _, f := range filters {
+			if TopicMatches(f, topic) {
+				retained = append(retained, m)
+				break
+			}
+		}
+	}
+	s.broker.notifyLocked()
+	s.broker.mu.Unlock()
+
+	ack := append([]byte(nil), id...)
+	ack = append(ack, make([]byte, len(filters))...) // granted qos 0
+	s.write(pktSuback<<4, ack)
+
+	for _, m := range retained {
+		s.writePublish(m.Topic, m.Payload, true)
+	}
+}
+
+func (s *conn) handleUnsubscribe(body []byte) {
+	r := &reader{b: body}
+	id := r.raw(2)
+
+	s.broker.mu.Lock()
+	for len(r.b) > 0 && r.err == nil {
+		delete(s.subs, r.str())
+	}
+	s.broker.notifyLocked()
+	s.broker.mu.Unlock()
+
+	s.write(pktUnsuback<<4, id)
+}
+
+func (s *conn) disconnect(publishWill bool) {
+	s.broker.mu.Lock()
+	_, connected := s.broker.clients[s]
+	delete(s.broker.clients, s)
+	s.broker.notifyLocked()
+	s.broker.mu.Unlock()
+
+	s.Close()
+
+	if connected && publishWill && s.will != nil {
+		s.broker.route(*s.will)
+		s.will = nil
+	}
+}
+
+func (s *conn) writePublish(topic string, payload []byte, retain bool) {
+	header := byte(pktPublish << 4)
+	if retain {
+		header |= 0x01
+	}
+	body := make([]byte, 2, 2+len(topic)+len(payload))
+	binary.BigEndian.PutUint16(body, uint16(len(topic)))
+	body = append(body, topic...)
+	body = append(body, payload...)
+	s.write(header, body)
+}
+
+func (s *conn) write(header byte, body []byte) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	pkt := []byte{header}
+	pkt = appendRemainingLength(pkt, len(body))
+	pkt = append(pkt, body...)
+	s.Conn.Write(pkt)
+}
+
+func readPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	header, err = r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	length, mult := 0, 1
+	for i := 0; ; i++ {
+		if i >= 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7F) * mult
+		mult *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body = make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+func appendRemainingLength(b []byte, length int) []byte {
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
+
+// Sequential reader of MQTT fields; the first error sticks
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (s *reader) raw(n int) []byte {
+	if s.err != nil || len(s.b) < n {
+		s.err = fmt.Errorf("packet too short")
+		return make([]byte, n)
+	}
+	ret := s.b[:n]
+	s.b = s.b[n:]
+	return ret
+}
+
+func (s *reader) byte() byte {
+	return s.raw(1)[0]
+}
+
+func (s *reader) u16() uint16 {
+	return binary.BigEndian.Uint16(s.raw(2))
+}
+
+func (s *reader) bytes() []byte {
+	return append([]byte(nil), s.raw(int(s.u16()))...)
+}
+
+func (s *reader) str() string {
+	return string(s.raw(int(s.u16())))
+}
+
+// MQTT topic filter matching, with `+` and `#` wildcards
+func TopicMatches(filter, topic string) bool {
+	fparts := strings.Split(filter, "/")
+	tparts := strings.Split(topic, "/")
+
+	for i, f := range fparts {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tparts) {
+			return false
+		}
+		if f != "+" && f != tparts[i] {
+			return false
+		}
+	}
+	return len(fparts) == len(tparts)
+}
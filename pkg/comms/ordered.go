@@ -0,0 +1,128 @@
+package comms
+
+import (
+	"hash/fnv"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Runs jobs on a fixed set of workers. Jobs with the same key always land on
+// the same worker, so they run in the order queued; different keys run in
+// parallel. Queuing blocks once a worker's buffer is full
+type orderedQueue struct {
+	mu      sync.RWMutex
+	closed  bool
+	workers []chan func()
+	wg      sync.WaitGroup
+}
+
+func newOrderedQueue(workers, buffer int) *orderedQueue {
+	q := &orderedQueue{
+		workers: make([]chan func(), workers),
+	}
+	q.wg.Add(workers)
+	for i := range q.workers {
+		jobs := make(chan func(), buffer)
+		q.workers[i] = jobs
+		go func() {
+			defer q.wg.Done()
+			for job := range jobs {
+				job()
+			}
+		}()
+	}
+	return q
+}
+
+// Jobs queued after `Close` are dropped
+func (s *orderedQueue) Enqueue(key string, job func()) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	s.workers[h.Sum32()%uint32(len(s.workers))] <- job
+}
+
+// Wait for everything queued so far to run
+func (s *orderedQueue) Flush() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(s.workers))
+	for _, jobs := range s.workers {
+		jobs <- wg.Done
+	}
+	wg.Wait()
+}
+
+// Run what's queued, then stop the workers
+func (s *orderedQueue) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	for _, jobs := range s.workers {
+		close(jobs)
+	}
+	s.wg.Wait()
+}
+
+// Hands messages to `f` one at a time, in order, on its own goroutine.
+// Callers only block once `buffer` messages are waiting
+type orderedDelivery struct {
+	mu     sync.RWMutex
+	closed bool
+	c      chan mqtt.Message
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newOrderedDelivery(buffer int, f func(mqtt.Message)) *orderedDelivery {
+	ret := &orderedDelivery{
+		c:    make(chan mqtt.Message, buffer),
+		done: make(chan struct{}),
+	}
+	go func() {
+		for m := range ret.c {
+			f(m)
+		}
+	}()
+	return ret
+}
+
+// Messages delivered after `Close` are dropped
+func (s *orderedDelivery) Deliver(m mqtt.Message) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.c <- m:
+	case <-s.done:
+	}
+}
+
+// Stop the goroutine once what's waiting is handled. Doesn't wait for it,
+// and unblocks anyone stuck delivering to a full buffer
+func (s *orderedDelivery) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.closed = true
+		close(s.c)
+	})
+}
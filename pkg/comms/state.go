@@ -21,9 +21,22 @@ type DeviceClass struct {
 type SensorType string
 
 const (
-	ST_BINARY_SENSOR SensorType = "binary_sensor"
-	ST_SENSOR        SensorType = "sensor"
-	ST_SWITCH        SensorType = "switch"
+	ST_BINARY_SENSOR  SensorType = "binary_sensor"
+	ST_SENSOR         SensorType = "sensor"
+	ST_SWITCH         SensorType = "switch"
+	ST_BUTTON         SensorType = "button"
+	ST_NUMBER         SensorType = "number"
+	ST_SELECT         SensorType = "select"
+	ST_TEXT           SensorType = "text"
+	ST_LIGHT          SensorType = "light"
+	ST_SIREN          SensorType = "siren"
+	ST_LOCK           SensorType = "lock"
+	ST_CAMERA         SensorType = "camera"
+	ST_IMAGE          SensorType = "image"
+	ST_EVENT          SensorType = "event"
+	ST_UPDATE         SensorType = "update"
+	ST_DEVICE_TRACKER SensorType = "device_tracker"
+	ST_SCENE          SensorType = "scene"
 )
 
 type SensorCategory string
@@ -34,13 +47,9 @@ var (
 	EC_DIAGNOSTIC SensorCategory = "diagnostic"
 )
 
+// HA device_class; see classes.go for the catalog
 type SensorClassType string
 
-var (
-	SC_MOTION  SensorClassType = "motion"
-	SC_BATTERY SensorClassType = "battery"
-)
-
 type SensorState string
 
 const (
@@ -74,6 +83,13 @@ type Sensor struct {
 	UnitOfMeasurement string
 	Category          SensorCategory
 	ClassType         SensorClassType
+	StateClass        StateClass
+
+	// Advertise a `json_attributes_topic`, for `PublishAttributes`
+	HasAttributes bool
+
+	// Choices for select, or event types for event
+	Options []string
 
 	Extra map[string]interface{}
 }
@@ -82,6 +98,11 @@ type SensorTopic interface {
 	StateTopic() string
 }
 
+type SensorAttributesTopic interface {
+	SensorTopic
+	AttributesTopic() string
+}
+
 func (s *Sensor) SanitizedName() string {
 	return sanitize(s.Name)
 }
@@ -101,6 +122,15 @@ func (s *Sensor) StateTopic() string {
 		sanitize(s.Name))
 }
 
+// Where HA sends commands, for platforms that take them (button, number, light...)
+func (s *Sensor) CommandTopic() string {
+	return path.Join(s.StateTopic(), "set")
+}
+
+func (s *Sensor) AttributesTopic() string {
+	return path.Join(s.StateTopic(), "attributes")
+}
+
 var santizeRegex = regexp.MustCompile(`[^a-zA-Z0-9\-]+`)
 
 func sanitize(s string) string {
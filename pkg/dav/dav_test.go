@@ -0,0 +1,204 @@
+package dav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x1F, 0xAC}
+	testPPS = []byte{0x68, 0xEE, 0x3C, 0x80}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	testP   = []byte{0x41, 0x9A, 0x02}
+)
+
+func annexB(nals ...[]byte) []byte {
+	var b bytes.Buffer
+	for _, nal := range nals {
+		b.Write([]byte{0, 0, 0, 1})
+		b.Write(nal)
+	}
+	return b.Bytes()
+}
+
+func davFrame(typ FrameType, seq uint32, relMs uint16, ext, payload []byte) []byte {
+	total := headerLen + len(ext) + len(payload) + trailerLen
+
+	var b bytes.Buffer
+	b.WriteString("DHAV")
+	b.Write([]byte{byte(typ), 0, 0, 0})
+	binary.Write(&b, binary.LittleEndian, seq)
+	binary.Write(&b, binary.LittleEndian, uint32(total))
+	binary.Write(&b, binary.LittleEndian, uint32(23<<26|1<<22|24<<17|10<<12|20<<6|30))
+	binary.Write(&b, binary.LittleEndian, relMs)
+	b.Write([]byte{byte(len(ext)), 0})
+	b.Write(ext)
+	b.Write(payload)
+	b.WriteString("dhav")
+	binary.Write(&b, binary.LittleEndian, uint32(total))
+	return b.Bytes()
+}
+
+func testStream() []byte {
+	keyExt := []byte{0x80, 0, 80, 45, 0x81, 0, byte(VC_H264), 20}
+
+	var b bytes.Buffer
+	b.Write(davFrame(FT_VIDEO_I, 1, 1000, keyExt, annexB(testSPS, testPPS, testIDR)))
+	b.Write(davFrame(FT_AUDIO, 2, 1010, nil, []byte{1, 2, 3}))
+	b.Write(davFrame(FT_VIDEO_P, 3, 1050, nil, annexB(testP)))
+	b.Write(davFrame(FT_VIDEO_P, 4, 1100, nil, annexB(testP)))
+	return b.Bytes()
+}
+
+func TestReadFrames(t *testing.T) {
+	r := NewReader(bytes.NewReader(append([]byte("junk"), testStream()...)))
+
+	frame, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, FT_VIDEO_I, frame.Type)
+	assert.Equal(t, VC_H264, frame.Codec)
+	assert.Equal(t, 640, frame.Width)
+	assert.Equal(t, 360, frame.Height)
+	assert.Equal(t, 20, frame.FrameRate)
+	assert.Equal(t, 2023, frame.Time.Year())
+	assert.Equal(t, uint16(1000), frame.RelTimeMs)
+
+	frame, err = r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, FT_AUDIO, frame.Type)
+	assert.Equal(t, []byte{1, 2, 3}, frame.Payload)
+
+	frame, err = r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, FT_VIDEO_P, frame.Type)
+	assert.Equal(t, 640, frame.Width, "carried forward")
+
+	_, err = r.Next()
+	require.NoError(t, err)
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadTruncated(t *testing.T) {
+	stream := testStream()
+	r := NewReader(bytes.NewReader(stream[:len(stream)-5]))
+	for i := 0; i < 3; i++ {
+		_, err := r.Next()
+		require.NoError(t, err)
+	}
+	_, err := r.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	nals := splitAnnexB([]byte{0, 0, 0, 1, 0x67, 1, 0, 0, 1, 0x68, 2})
+	assert.Equal(t, [][]byte{{0x67, 1}, {0x68, 2}}, nals)
+	assert.Equal(t, []byte{0, 0, 1, 0, 0}, unescapeRbsp([]byte{0, 0, 3, 1, 0, 0, 3}))
+}
+
+func TestRemuxToMP4(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.mp4")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+
+	stats, err := RemuxToMP4(bytes.NewReader(testStream()), f)
+	require.NoError(t, err)
+	f.Close()
+
+	assert.Equal(t, 3, stats.Frames)
+	assert.Equal(t, VC_H264, stats.Codec)
+	assert.Equal(t, uint32(50+50+50), stats.Duration)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	boxes := topLevelBoxes(t, data)
+	assert.Equal(t, []string{"ftyp", "mdat", "moov"}, boxNames(boxes))
+
+	// Samples are length-prefixed, without parameter sets
+	mdat := boxes[1].body
+	assert.Equal(t, uint32(len(testIDR)), binary.BigEndian.Uint32(mdat))
+	assert.Equal(t, testIDR, mdat[4:4+len(testIDR)])
+
+	moov := boxes[2].body
+	assert.True(t, bytes.Contains(moov, []byte("avcC")))
+	assert.True(t, bytes.Contains(moov, testSPS))
+	assert.True(t, bytes.Contains(moov, testPPS))
+	assert.True(t, bytes.Contains(moov, []byte("stss")))
+}
+
+func TestRemuxMidGOP(t *testing.T) {
+	// P-frames from before the clip's first key frame; the codec isn't known yet
+	var b bytes.Buffer
+	b.Write(davFrame(FT_VIDEO_P, 1, 900, nil, annexB(testP)))
+	b.Write(davFrame(FT_VIDEO_P, 2, 950, nil, annexB(testP)))
+	b.Write(testStream())
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.mp4"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	stats, err := RemuxToMP4(bytes.NewReader(b.Bytes()), f)
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Frames)
+	assert.Equal(t, VC_H264, stats.Codec)
+}
+
+func TestRemuxUnsupportedCodec(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.mp4"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	keyExt := []byte{0x80, 0, 80, 45, 0x81, 0, byte(VC_MPEG4), 20}
+	_, err = RemuxToMP4(bytes.NewReader(davFrame(FT_VIDEO_I, 1, 0, keyExt, annexB(testIDR))), f)
+	assert.ErrorIs(t, err, ErrUnsupportedCodec)
+}
+
+func TestRemuxNoVideo(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.mp4"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = RemuxToMP4(bytes.NewReader(davFrame(FT_AUDIO, 1, 0, nil, []byte{1})), f)
+	assert.ErrorIs(t, err, ErrNoVideo)
+}
+
+func TestRemuxMissingParameterSets(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.mp4"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	keyExt := []byte{0x80, 0, 80, 45, 0x81, 0, byte(VC_H264), 20}
+	_, err = RemuxToMP4(bytes.NewReader(davFrame(FT_VIDEO_I, 1, 0, keyExt, annexB(testIDR))), f)
+	assert.ErrorIs(t, err, ErrMissingParameterSets)
+}
+
+type testBox struct {
+	name string
+	body []byte
+}
+
+func topLevelBoxes(t *testing.T, data []byte) (ret []testBox) {
+	for len(data) > 0 {
+		require.GreaterOrEqual(t, len(data), 8)
+		size := int(binary.BigEndian.Uint32(data))
+		require.GreaterOrEqual(t, len(data), size)
+		ret = append(ret, testBox{string(data[4:8]), data[8:size]})
+		data = data[size:]
+	}
+	return
+}
+
+func boxNames(boxes []testBox) (ret []string) {
+	for _, b := range boxes {
+		ret = append(ret, b.name)
+	}
+	return
+}
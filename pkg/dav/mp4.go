@@ -0,0 +1,472 @@
+package dav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+/*
+Remux a DAV stream to a (non-fragmented) MP4. Only the video track is kept,
+which is enough for the clip to be playable anywhere. Samples are written
+to `mdat` as they're read, and the `moov` index is appended at the end
+*/
+
+var (
+	ErrUnsupportedCodec     = errors.New("unsupported video codec")
+	ErrNoVideo              = errors.New("no video frames in stream")
+	ErrMissingParameterSets = errors.New("stream missing parameter sets")
+)
+
+const timescale = 1000 // DAV timestamps are ms
+
+type RemuxStats struct {
+	Frames   int
+	Duration uint32 // ms
+	Codec    VideoCodec
+	Width    int
+	Height   int
+}
+
+type sample struct {
+	offset   uint32
+	size     uint32
+	duration uint32
+	key      bool
+}
+
+type muxer struct {
+	w         io.WriteSeeker
+	offset    int64
+	mdatStart int64
+
+	codec           VideoCodec
+	width, height   int
+	frameRate       int
+	vps, sps, pps   [][]byte
+	samples         []sample
+	lastRel         uint16
+	havePrevious    bool
+	defaultDuration uint32
+}
+
+// RemuxToMP4 reads DAV from `r` and writes an MP4 to `w`. A truncated final
+// frame is tolerated (the recording may have been cut off)
+func RemuxToMP4(r io.Reader, w io.WriteSeeker) (*RemuxStats, error) {
+	m := &muxer{w: w}
+
+	if err := m.writeHeader(); err != nil {
+		return nil, err
+	}
+
+	reader := NewReader(r)
+	for {
+		frame, err := reader.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !frame.Type.IsVideo() {
+			continue
+		}
+		if err := m.writeFrame(frame); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(m.samples) == 0 {
+		return nil, ErrNoVideo
+	}
+
+	if err := m.finish(); err != nil {
+		return nil, err
+	}
+
+	return &RemuxStats{
+		Frames:   len(m.samples),
+		Duration: m.duration(),
+		Codec:    m.codec,
+		Width:    m.width,
+		Height:   m.height,
+	}, nil
+}
+
+func (s *muxer) write(b []byte) error {
+	n, err := s.w.Write(b)
+	s.offset += int64(n)
+	return err
+}
+
+func (s *muxer) writeHeader() error {
+	var b bytes.Buffer
+	writeBox(&b, "ftyp", func(b *bytes.Buffer) {
+		b.WriteString("isom")
+		writeU32(b, 0x200)
+		b.WriteString("isomiso2mp41")
+	})
+	// mdat size is patched in `finish`
+	s.mdatStart = int64(b.Len())
+	writeU32(&b, 0)
+	b.WriteString("mdat")
+	return s.write(b.Bytes())
+}
+
+func (s *muxer) writeFrame(frame *Frame) error {
+	if s.codec == VC_UNKNOWN {
+		if frame.Type != FT_VIDEO_I {
+			// Can't start decoding until the first key frame. Clips can start
+			// mid-GOP, before the codec is even known
+			return nil
+		}
+		if frame.Codec != VC_H264 && frame.Codec != VC_H265 {
+			return fmt.Errorf("%w: %s", ErrUnsupportedCodec, frame.Codec)
+		}
+		s.codec = frame.Codec
+		s.width, s.height = frame.Width, frame.Height
+		s.frameRate = frame.FrameRate
+		s.defaultDuration = timescale / 25
+		if s.frameRate > 0 {
+			s.defaultDuration = uint32(timescale / s.frameRate)
+		}
+	}
+
+	// Timing from relative-ms deltas
+	if s.havePrevious {
+		delta := uint32(frame.RelTimeMs - s.lastRel) // wraps
+		if delta == 0 || delta > 10*timescale {
+			delta = s.defaultDuration
+		}
+		s.samples[len(s.samples)-1].duration = delta
+	}
+	s.lastRel = frame.RelTimeMs
+	s.havePrevious = true
+
+	// Convert annex-b to length-prefixed, pulling out parameter sets
+	var buf bytes.Buffer
+	for _, nal := range splitAnnexB(frame.Payload) {
+		switch classifyNal(s.codec, nal) {
+		case nalVPS:
+			s.vps = appendUnique(s.vps, nal)
+		case nalSPS:
+			s.sps = appendUnique(s.sps, nal)
+		case nalPPS:
+			s.pps = appendUnique(s.pps, nal)
+		case nalAUD:
+		default:
+			writeU32(&buf, uint32(len(nal)))
+			buf.Write(nal)
+		}
+	}
+
+	if s.offset+int64(buf.Len()) > math.MaxUint32 {
+		return errors.New("clip too large for mp4")
+	}
+
+	s.samples = append(s.samples, sample{
+		offset:   uint32(s.offset),
+		size:     uint32(buf.Len()),
+		duration: s.defaultDuration,
+		key:      frame.Type == FT_VIDEO_I,
+	})
+
+	return s.write(buf.Bytes())
+}
+
+func (s *muxer) duration() (total uint32) {
+	for _, smp := range s.samples {
+		total += smp.duration
+	}
+	return
+}
+
+func (s *muxer) finish() error {
+	if len(s.sps) == 0 || len(s.pps) == 0 {
+		return ErrMissingParameterSets
+	}
+
+	// Patch mdat size now that we know it
+	end := s.offset
+	if _, err := s.w.Seek(s.mdatStart, io.SeekStart); err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(end-s.mdatStart))
+	if _, err := s.w.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := s.w.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	s.writeMoov(&b)
+	return s.write(b.Bytes())
+}
+
+func (s *muxer) writeMoov(b *bytes.Buffer) {
+	duration := s.duration()
+
+	writeBox(b, "moov", func(b *bytes.Buffer) {
+		writeFullBox(b, "mvhd", 0, 0, func(b *bytes.Buffer) {
+			writeU32(b, 0) // creation
+			writeU32(b, 0) // modification
+			writeU32(b, timescale)
+			writeU32(b, duration)
+			writeU32(b, 0x00010000) // rate 1.0
+			writeU16(b, 0x0100)     // volume 1.0
+			b.Write(make([]byte, 10))
+			writeMatrix(b)
+			b.Write(make([]byte, 24))
+			writeU32(b, 2) // next track id
+		})
+		writeBox(b, "trak", func(b *bytes.Buffer) {
+			writeFullBox(b, "tkhd", 0, 3, func(b *bytes.Buffer) {
+				writeU32(b, 0) // creation
+				writeU32(b, 0) // modification
+				writeU32(b, 1) // track id
+				writeU32(b, 0)
+				writeU32(b, duration)
+				b.Write(make([]byte, 8))
+				writeU16(b, 0) // layer
+				writeU16(b, 0) // alternate group
+				writeU16(b, 0) // volume
+				writeU16(b, 0)
+				writeMatrix(b)
+				writeU32(b, uint32(s.width)<<16)
+				writeU32(b, uint32(s.height)<<16)
+			})
+			writeBox(b, "mdia", func(b *bytes.Buffer) {
+				writeFullBox(b, "mdhd", 0, 0, func(b *bytes.Buffer) {
+					writeU32(b, 0)
+					writeU32(b, 0)
+					writeU32(b, timescale)
+					writeU32(b, duration)
+					writeU16(b, 0x55C4) // "und"
+					writeU16(b, 0)
+				})
+				writeFullBox(b, "hdlr", 0, 0, func(b *bytes.Buffer) {
+					writeU32(b, 0)
+					b.WriteString("vide")
+					b.Write(make([]byte, 12))
+					b.WriteString("VideoHandler\x00")
+				})
+				writeBox(b, "minf", func(b *bytes.Buffer) {
+					writeFullBox(b, "vmhd", 0, 1, func(b *bytes.Buffer) {
+						b.Write(make([]byte, 8))
+					})
+					writeBox(b, "dinf", func(b *bytes.Buffer) {
+						writeFullBox(b, "dref", 0, 0, func(b *bytes.Buffer) {
+							writeU32(b, 1)
+							writeFullBox(b, "url ", 0, 1, func(b *bytes.Buffer) {})
+						})
+					})
+					s.writeStbl(b)
+				})
+			})
+		})
+	})
+}
+
+func (s *muxer) writeStbl(b *bytes.Buffer) {
+	writeBox(b, "stbl", func(b *bytes.Buffer) {
+		writeFullBox(b, "stsd", 0, 0, func(b *bytes.Buffer) {
+			writeU32(b, 1)
+			s.writeSampleEntry(b)
+		})
+
+		writeFullBox(b, "stts", 0, 0, func(b *bytes.Buffer) {
+			type run struct{ count, delta uint32 }
+			var runs []run
+			for _, smp := range s.samples {
+				if len(runs) > 0 && runs[len(runs)-1].delta == smp.duration {
+					runs[len(runs)-1].count++
+				} else {
+					runs = append(runs, run{1, smp.duration})
+				}
+			}
+			writeU32(b, uint32(len(runs)))
+			for _, r := range runs {
+				writeU32(b, r.count)
+				writeU32(b, r.delta)
+			}
+		})
+
+		var keys []uint32
+		for i, smp := range s.samples {
+			if smp.key {
+				keys = append(keys, uint32(i+1))
+			}
+		}
+		if len(keys) != len(s.samples) {
+			writeFullBox(b, "stss", 0, 0, func(b *bytes.Buffer) {
+				writeU32(b, uint32(len(keys)))
+				for _, k := range keys {
+					writeU32(b, k)
+				}
+			})
+		}
+
+		// One sample per chunk keeps the offsets trivial
+		writeFullBox(b, "stsc", 0, 0, func(b *bytes.Buffer) {
+			writeU32(b, 1)
+			writeU32(b, 1) // first chunk
+			writeU32(b, 1) // samples per chunk
+			writeU32(b, 1) // description index
+		})
+		writeFullBox(b, "stsz", 0, 0, func(b *bytes.Buffer) {
+			writeU32(b, 0)
+			writeU32(b, uint32(len(s.samples)))
+			for _, smp := range s.samples {
+				writeU32(b, smp.size)
+			}
+		})
+		writeFullBox(b, "stco", 0, 0, func(b *bytes.Buffer) {
+			writeU32(b, uint32(len(s.samples)))
+			for _, smp := range s.samples {
+				writeU32(b, smp.offset)
+			}
+		})
+	})
+}
+
+func (s *muxer) writeSampleEntry(b *bytes.Buffer) {
+	entryType := "avc1"
+	if s.codec == VC_H265 {
+		entryType = "hvc1"
+	}
+
+	writeBox(b, entryType, func(b *bytes.Buffer) {
+		b.Write(make([]byte, 6))
+		writeU16(b, 1) // data reference index
+		b.Write(make([]byte, 16))
+		writeU16(b, uint16(s.width))
+		writeU16(b, uint16(s.height))
+		writeU32(b, 0x00480000) // 72 dpi
+		writeU32(b, 0x00480000)
+		writeU32(b, 0)
+		writeU16(b, 1) // frame count
+		b.Write(make([]byte, 32))
+		writeU16(b, 0x0018) // depth
+		writeU16(b, 0xFFFF)
+
+		if s.codec == VC_H265 {
+			writeBox(b, "hvcC", s.writeHvcC)
+		} else {
+			writeBox(b, "avcC", s.writeAvcC)
+		}
+	})
+}
+
+func (s *muxer) writeAvcC(b *bytes.Buffer) {
+	sps := s.sps[0]
+	b.WriteByte(1)
+	if len(sps) >= 4 {
+		b.Write(sps[1:4]) // profile, compatibility, level
+	} else {
+		b.Write([]byte{0, 0, 0})
+	}
+	b.WriteByte(0xFF) // 4-byte lengths
+	b.WriteByte(0xE0 | byte(len(s.sps)))
+	for _, nal := range s.sps {
+		writeU16(b, uint16(len(nal)))
+		b.Write(nal)
+	}
+	b.WriteByte(byte(len(s.pps)))
+	for _, nal := range s.pps {
+		writeU16(b, uint16(len(nal)))
+		b.Write(nal)
+	}
+}
+
+func (s *muxer) writeHvcC(b *bytes.Buffer) {
+	// General profile_tier_level immediately follows the 2-byte nal header and 1 byte
+	// of vps-id/sub-layers in the SPS. Chroma & bit-depth assume 8-bit 4:2:0
+	ptl := make([]byte, 12)
+	if rbsp := unescapeRbsp(s.sps[0]); len(rbsp) >= 15 {
+		copy(ptl, rbsp[3:15])
+	}
+
+	b.WriteByte(1)
+	b.Write(ptl)
+	writeU16(b, 0xF000) // min spatial segmentation
+	b.WriteByte(0xFC)   // parallelism
+	b.WriteByte(0xFD)   // chroma 4:2:0
+	b.WriteByte(0xF8)   // luma bit depth - 8
+	b.WriteByte(0xF8)   // chroma bit depth - 8
+	writeU16(b, 0)      // avg frame rate
+	b.WriteByte(0x0F)   // 1 temporal layer, nested, 4-byte lengths
+
+	arrays := []struct {
+		nalType byte
+		nals    [][]byte
+	}{
+		{32, s.vps},
+		{33, s.sps},
+		{34, s.pps},
+	}
+	count := 0
+	for _, arr := range arrays {
+		if len(arr.nals) > 0 {
+			count++
+		}
+	}
+	b.WriteByte(byte(count))
+	for _, arr := range arrays {
+		if len(arr.nals) == 0 {
+			continue
+		}
+		b.WriteByte(0x80 | arr.nalType)
+		writeU16(b, uint16(len(arr.nals)))
+		for _, nal := range arr.nals {
+			writeU16(b, uint16(len(nal)))
+			b.Write(nal)
+		}
+	}
+}
+
+func appendUnique(set [][]byte, nal []byte) [][]byte {
+	for _, existing := range set {
+		if bytes.Equal(existing, nal) {
+			return set
+		}
+	}
+	return append(set, append([]byte(nil), nal...))
+}
+
+func writeBox(b *bytes.Buffer, typ string, body func(b *bytes.Buffer)) {
+	start := b.Len()
+	writeU32(b, 0)
+	b.WriteString(typ)
+	body(b)
+	binary.BigEndian.PutUint32(b.Bytes()[start:], uint32(b.Len()-start))
+}
+
+func writeFullBox(b *bytes.Buffer, typ string, version byte, flags uint32, body func(b *bytes.Buffer)) {
+	writeBox(b, typ, func(b *bytes.Buffer) {
+		writeU32(b, uint32(version)<<24|flags&0xFFFFFF)
+		body(b)
+	})
+}
+
+func writeMatrix(b *bytes.Buffer) {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		writeU32(b, v)
+	}
+}
+
+func writeU32(b *bytes.Buffer, v uint32) {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	b.Write(tmp[:])
+}
+
+func writeU16(b *bytes.Buffer, v uint16) {
+	var tmp [2]byte
+	binary.BigEndian.PutUint16(tmp[:], v)
+	b.Write(tmp[:])
+}
@@ -0,0 +1,98 @@
+package dav
+
+import "bytes"
+
+// Split an Annex-B byte-stream into its NAL units (start codes removed)
+func splitAnnexB(b []byte) (nals [][]byte) {
+	start := -1
+	for i := 0; i+2 < len(b); {
+		if b[i] == 0 && b[i+1] == 0 && b[i+2] == 1 {
+			if start >= 0 {
+				nals = appendNal(nals, b[start:i])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 {
+		nals = appendNal(nals, b[start:])
+	} else if len(b) > 0 {
+		// No start codes at all; treat as one unit
+		nals = appendNal(nals, b)
+	}
+	return
+}
+
+func appendNal(nals [][]byte, nal []byte) [][]byte {
+	// The 4-byte start code leaves a trailing zero on the previous unit
+	nal = bytes.TrimRight(nal, "\x00")
+	if len(nal) == 0 {
+		return nals
+	}
+	return append(nals, nal)
+}
+
+// Strip emulation-prevention bytes (00 00 03 -> 00 00)
+func unescapeRbsp(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+type nalKind int
+
+const (
+	nalOther nalKind = iota
+	nalVPS
+	nalSPS
+	nalPPS
+	nalAUD
+	nalIDR
+)
+
+func classifyNal(codec VideoCodec, nal []byte) nalKind {
+	if len(nal) == 0 {
+		return nalOther
+	}
+	switch codec {
+	case VC_H264:
+		switch nal[0] & 0x1F {
+		case 5:
+			return nalIDR
+		case 7:
+			return nalSPS
+		case 8:
+			return nalPPS
+		case 9:
+			return nalAUD
+		}
+	case VC_H265:
+		switch t := (nal[0] >> 1) & 0x3F; {
+		case t >= 16 && t <= 21:
+			return nalIDR
+		case t == 32:
+			return nalVPS
+		case t == 33:
+			return nalSPS
+		case t == 34:
+			return nalPPS
+		case t == 35:
+			return nalAUD
+		}
+	}
+	return nalOther
+}
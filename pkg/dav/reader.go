@@ -0,0 +1,232 @@
+package dav
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+Dahua "DAV" is the container the doorbell records into (even when the file is named `.mp4`).
+It's a sequence of frames, each wrapped in a `DHAV` header and `dhav` trailer:
+
+	0   "DHAV"
+	4   frame type (0xFD I-frame, 0xFC P-frame, 0xF0 audio, 0xF1 aux)
+	5   sub-type
+	6   channel
+	7   sub-frame
+	8   sequence (LE u32)
+	12  total frame length, header to trailer inclusive (LE u32)
+	16  packed date-time (LE u32)
+	20  relative timestamp in ms (LE u16, wraps)
+	22  extension header length
+	23  checksum
+	24  extension headers, then payload
+	..  "dhav" + total frame length (LE u32)
+
+Layout is largely taken from ffmpeg's libavformat/dhav.c
+*/
+
+var (
+	ErrBadFrame = errors.New("malformed dav frame")
+)
+
+var (
+	headerMagic  = []byte("DHAV")
+	trailerMagic = []byte("dhav")
+)
+
+const (
+	headerLen  = 24
+	trailerLen = 8
+	maxFrame   = 16 * 1024 * 1024
+)
+
+type FrameType byte
+
+const (
+	FT_VIDEO_I FrameType = 0xFD
+	FT_VIDEO_P FrameType = 0xFC
+	FT_AUDIO   FrameType = 0xF0
+	FT_AUX     FrameType = 0xF1
+)
+
+func (s FrameType) IsVideo() bool {
+	return s == FT_VIDEO_I || s == FT_VIDEO_P
+}
+
+type VideoCodec byte
+
+const (
+	VC_UNKNOWN VideoCodec = 0
+	VC_MPEG4   VideoCodec = 0x01
+	VC_H264    VideoCodec = 0x02
+	VC_H265    VideoCodec = 0x0C
+)
+
+func (s VideoCodec) String() string {
+	switch s {
+	case VC_MPEG4:
+		return "mpeg4"
+	case VC_H264:
+		return "h264"
+	case VC_H265:
+		return "h265"
+	}
+	return fmt.Sprintf("unknown(0x%02x)", byte(s))
+}
+
+type Frame struct {
+	Type      FrameType
+	Channel   byte
+	Sequence  uint32
+	Time      time.Time // Wall-clock, second resolution
+	RelTimeMs uint16    // Relative timestamp, wraps at 65536
+
+	// Stream info, carried forward from the last frame that declared it
+	Width, Height int
+	Codec         VideoCodec
+	FrameRate     int
+
+	Payload []byte // Annex-B for video
+}
+
+type Reader struct {
+	r *bufio.Reader
+
+	width, height int
+	codec         VideoCodec
+	frameRate     int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r: bufio.NewReaderSize(r, 64*1024),
+	}
+}
+
+// Sniff returns true if the stream looks like DAV. Doesn't consume from `r`
+func Sniff(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(headerMagic))
+	return err == nil && bytes.Equal(magic, headerMagic)
+}
+
+// Next returns the next frame, or io.EOF at a clean end of stream. A truncated
+// final frame (eg. the file was still being written) returns io.ErrUnexpectedEOF
+func (s *Reader) Next() (*Frame, error) {
+	if err := s.sync(); err != nil {
+		return nil, err
+	}
+
+	var hdr [headerLen]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		return nil, unexpected(err)
+	}
+
+	totalLen := int(binary.LittleEndian.Uint32(hdr[12:16]))
+	extLen := int(hdr[22])
+	payloadLen := totalLen - headerLen - extLen - trailerLen
+	if payloadLen < 0 || totalLen > maxFrame {
+		return nil, fmt.Errorf("%w: length %d", ErrBadFrame, totalLen)
+	}
+
+	body := make([]byte, extLen+payloadLen+trailerLen)
+	if _, err := io.ReadFull(s.r, body); err != nil {
+		return nil, unexpected(err)
+	}
+
+	trailer := body[len(body)-trailerLen:]
+	if !bytes.Equal(trailer[:4], trailerMagic) || int(binary.LittleEndian.Uint32(trailer[4:])) != totalLen {
+		return nil, fmt.Errorf("%w: bad trailer", ErrBadFrame)
+	}
+
+	frame := &Frame{
+		Type:      FrameType(hdr[4]),
+		Channel:   hdr[6],
+		Sequence:  binary.LittleEndian.Uint32(hdr[8:12]),
+		Time:      parseDateTime(binary.LittleEndian.Uint32(hdr[16:20])),
+		RelTimeMs: binary.LittleEndian.Uint16(hdr[20:22]),
+		Payload:   body[extLen : extLen+payloadLen],
+	}
+
+	s.parseExtensions(body[:extLen])
+	frame.Width, frame.Height = s.width, s.height
+	frame.Codec = s.codec
+	frame.FrameRate = s.frameRate
+
+	return frame, nil
+}
+
+// Skip forward to the next header magic, allowing recovery from garbage between frames
+func (s *Reader) sync() error {
+	for {
+		magic, err := s.r.Peek(len(headerMagic))
+		if err != nil {
+			if err == io.EOF && len(magic) > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if bytes.Equal(magic, headerMagic) {
+			return nil
+		}
+		s.r.Discard(1)
+	}
+}
+
+func (s *Reader) parseExtensions(ext []byte) {
+	for len(ext) > 0 {
+		size := 4
+		switch ext[0] {
+		case 0x80: // video dimensions, in units of 8
+			if len(ext) >= 4 {
+				s.width, s.height = 8*int(ext[2]), 8*int(ext[3])
+			}
+		case 0x81: // codec & frame rate
+			if len(ext) >= 4 {
+				s.codec = VideoCodec(ext[2])
+				s.frameRate = int(ext[3])
+			}
+		case 0x82: // large video dimensions
+			size = 8
+			if len(ext) >= 8 {
+				s.width = int(binary.LittleEndian.Uint16(ext[4:6]))
+				s.height = int(binary.LittleEndian.Uint16(ext[6:8]))
+			}
+		case 0x88, 0x8c, 0x91, 0x92, 0x93, 0x95, 0x9a, 0x9b, 0xb3:
+			size = 8
+		case 0x83, 0x84, 0x85, 0x8b, 0x94, 0x96, 0xa0, 0xfe:
+			size = 4
+		default:
+			// Unknown, can't know its length so ignore the rest
+			return
+		}
+		if size > len(ext) {
+			return
+		}
+		ext = ext[size:]
+	}
+}
+
+func parseDateTime(v uint32) time.Time {
+	var (
+		sec   = int(v & 0x3F)
+		min   = int((v >> 6) & 0x3F)
+		hour  = int((v >> 12) & 0x1F)
+		day   = int((v >> 17) & 0x1F)
+		month = int((v >> 22) & 0x0F)
+		year  = int((v>>26)&0x3F) + 2000
+	)
+	return time.Date(year, time.Month(month), day, hour, min, sec, 0, time.Local)
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
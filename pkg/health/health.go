@@ -0,0 +1,202 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Named checks, served as `/healthz` (liveness: is the process wedged, and
+should be restarted) and `/readyz` (readiness: is it currently working).
+Readiness includes every liveness check
+*/
+
+// Returns nil when healthy
+type Check func() error
+
+type Checks struct {
+	mu    sync.Mutex
+	live  map[string]Check
+	ready map[string]Check
+}
+
+func New() *Checks {
+	return &Checks{
+		live:  make(map[string]Check),
+		ready: make(map[string]Check),
+	}
+}
+
+// A check that failing means the process should be restarted
+func (s *Checks) Live(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live[name] = check
+}
+
+// A check that failing means the process isn't working right now, but may recover
+func (s *Checks) Ready(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready[name] = check
+}
+
+type Result struct {
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type Report struct {
+	OK     bool              `json:"ok"`
+	Checks map[string]Result `json:"checks"`
+}
+
+func (s *Checks) CheckLive() Report {
+	return s.run(false)
+}
+
+func (s *Checks) CheckReady() Report {
+	return s.run(true)
+}
+
+func (s *Checks) run(ready bool) Report {
+	s.mu.Lock()
+	checks := make(map[string]Check, len(s.live)+len(s.ready))
+	for name, check := range s.live {
+		checks[name] = check
+	}
+	if ready {
+		for name, check := range s.ready {
+			checks[name] = check
+		}
+	}
+	s.mu.Unlock()
+
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ret := Report{OK: true, Checks: make(map[string]Result, len(checks))}
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			ret.OK = false
+			ret.Checks[name] = Result{Reason: err.Error()}
+		} else {
+			ret.Checks[name] = Result{OK: true}
+		}
+	}
+	return ret
+}
+
+func (s *Checks) LiveHandler() http.Handler {
+	return reportHandler(s.CheckLive)
+}
+
+func (s *Checks) ReadyHandler() http.Handler {
+	return reportHandler(s.CheckReady)
+}
+
+// 200 if OK, otherwise 503; with the report as JSON either way
+func reportHandler(check func() Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := check()
+		w.Header().Set("Content-Type", "application/json")
+		if !report.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// Time of the last success of something periodic, eg. a poll. Starts as now,
+// so there's a grace period on startup
+type Heartbeat struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func NewHeartbeat() *Heartbeat {
+	return &Heartbeat{last: time.Now()}
+}
+
+func (s *Heartbeat) Beat() {
+	s.mu.Lock()
+	s.last = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *Heartbeat) Age() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.last)
+}
+
+// Fails if there's been no beat in `maxAge`
+func (s *Heartbeat) Check(maxAge time.Duration) Check {
+	return func() error {
+		if age := s.Age(); age > maxAge {
+			return fmt.Errorf("last success %s ago, over %s", age.Round(time.Second), maxAge)
+		}
+		return nil
+	}
+}
+
+// Whether something (eg. a connection) is up, and since when
+type Status struct {
+	mu    sync.Mutex
+	up    bool
+	since time.Time
+	err   error
+}
+
+// Starts down, since now
+func NewStatus() *Status {
+	return &Status{since: time.Now()}
+}
+
+// Set up or down; `err` is why it's down, if known
+func (s *Status) Set(up bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if up != s.up {
+		s.since = time.Now()
+	}
+	s.up, s.err = up, err
+}
+
+// Fails while down
+func (s *Status) CheckUp() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.up {
+		return s.downError()
+	}
+	return nil
+}
+
+// Fails once down for longer than `grace`
+func (s *Status) CheckDownFor(grace time.Duration) Check {
+	return func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.up && time.Since(s.since) > grace {
+			return s.downError()
+		}
+		return nil
+	}
+}
+
+// Must hold lock
+func (s *Status) downError() error {
+	down := time.Since(s.since).Round(time.Second)
+	if s.err != nil {
+		return fmt.Errorf("down for %s: %v", down, s.err)
+	}
+	return fmt.Errorf("down for %s", down)
+}
@@ -0,0 +1,81 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, checks *Checks, ready bool) (int, Report) {
+	h := checks.LiveHandler()
+	if ready {
+		h = checks.ReadyHandler()
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	var report Report
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	return rec.Code, report
+}
+
+func TestChecks(t *testing.T) {
+	checks := New()
+	var mqttErr error
+	checks.Live("poll", func() error { return nil })
+	checks.Ready("mqtt", func() error { return mqttErr })
+
+	code, report := get(t, checks, true)
+	assert.Equal(t, 200, code)
+	assert.True(t, report.OK)
+	assert.Len(t, report.Checks, 2)
+
+	// Readiness failing doesn't make us unhealthy
+	mqttErr = errors.New("not connected")
+	code, report = get(t, checks, true)
+	assert.Equal(t, 503, code)
+	assert.False(t, report.OK)
+	assert.Equal(t, Result{Reason: "not connected"}, report.Checks["mqtt"])
+	assert.Equal(t, Result{OK: true}, report.Checks["poll"])
+
+	code, report = get(t, checks, false)
+	assert.Equal(t, 200, code)
+	assert.Len(t, report.Checks, 1)
+}
+
+func TestHeartbeat(t *testing.T) {
+	hb := NewHeartbeat()
+	check := hb.Check(20 * time.Millisecond)
+	assert.NoError(t, check())
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Error(t, check())
+
+	hb.Beat()
+	assert.NoError(t, check())
+}
+
+func TestStatus(t *testing.T) {
+	status := NewStatus()
+	downFor := status.CheckDownFor(20 * time.Millisecond)
+	assert.EqualError(t, status.CheckUp(), "down for 0s")
+	assert.NoError(t, downFor())
+
+	status.Set(true, nil)
+	assert.NoError(t, status.CheckUp())
+
+	status.Set(false, errors.New("eof"))
+	assert.EqualError(t, status.CheckUp(), "down for 0s: eof")
+	time.Sleep(30 * time.Millisecond)
+	assert.Error(t, downFor())
+
+	// Coming back resets how long it's been down
+	status.Set(true, nil)
+	status.Set(false, nil)
+	assert.NoError(t, downFor())
+}
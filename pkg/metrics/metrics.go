@@ -0,0 +1,330 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Just enough of Prometheus' client to expose counters, gauges and histograms
+(with labels) in the text exposition format. Metrics are declared once, as
+package vars, against `Default`
+*/
+
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+// Seconds; suits most request latencies
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+type family struct {
+	name, help string
+	typ        metricType
+	labels     []string
+	buckets    []float64 // Histograms only
+
+	mu     sync.Mutex
+	series map[string]*series // Joined label values ->
+}
+
+type series struct {
+	labels []string
+	value  float64 // Counter & gauge value, or histogram sum
+	count  uint64
+	counts []uint64 // Per bucket, not cumulative
+}
+
+func (s *Registry) register(name, help string, typ metricType, buckets []float64, labels []string) *family {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.families[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	s.families[name] = f
+	return f
+}
+
+func (s *family) with(values []string) *series {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", s.name, len(s.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret, ok := s.series[key]
+	if !ok {
+		ret = &series{labels: append([]string(nil), values...)}
+		if s.typ == typeHistogram {
+			ret.counts = make([]uint64, len(s.buckets))
+		}
+		s.series[key] = ret
+	}
+	return ret
+}
+
+// Counters
+
+type CounterVec struct{ f *family }
+
+type Counter struct {
+	f *family
+	s *series
+}
+
+func (s *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{s.register(name, help, typeCounter, nil, labels)}
+}
+
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounter(name, help, labels...)
+}
+
+func (s *CounterVec) With(labelValues ...string) *Counter {
+	return &Counter{s.f, s.f.with(labelValues)}
+}
+
+func (s *Counter) Inc() {
+	s.Add(1)
+}
+
+// Negative values are ignored; counters only go up
+func (s *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	s.f.mu.Lock()
+	s.s.value += v
+	s.f.mu.Unlock()
+}
+
+// Gauges
+
+type GaugeVec struct{ f *family }
+
+type Gauge struct {
+	f *family
+	s *series
+}
+
+func (s *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{s.register(name, help, typeGauge, nil, labels)}
+}
+
+func NewGauge(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGauge(name, help, labels...)
+}
+
+func (s *GaugeVec) With(labelValues ...string) *Gauge {
+	return &Gauge{s.f, s.f.with(labelValues)}
+}
+
+func (s *Gauge) Set(v float64) {
+	s.f.mu.Lock()
+	s.s.value = v
+	s.f.mu.Unlock()
+}
+
+func (s *Gauge) Add(v float64) {
+	s.f.mu.Lock()
+	s.s.value += v
+	s.f.mu.Unlock()
+}
+
+// As a unix timestamp, in seconds
+func (s *Gauge) SetToCurrentTime() {
+	s.Set(float64(time.Now().UnixNano()) / 1e9)
+}
+
+// Histograms
+
+type HistogramVec struct{ f *family }
+
+type Histogram struct {
+	f *family
+	s *series
+}
+
+// `buckets` are upper bounds, ascending; +Inf is implied. nil for `DefBuckets`
+func (s *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	return &HistogramVec{s.register(name, help, typeHistogram, buckets, labels)}
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+func (s *HistogramVec) With(labelValues ...string) *Histogram {
+	return &Histogram{s.f, s.f.with(labelValues)}
+}
+
+func (s *Histogram) Observe(v float64) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	s.s.value += v
+	s.s.count++
+	for i, le := range s.f.buckets {
+		if v <= le {
+			s.s.counts[i]++
+			break
+		}
+	}
+}
+
+// Observe the time since `start`, in seconds
+func (s *Histogram) ObserveSince(start time.Time) {
+	s.Observe(time.Since(start).Seconds())
+}
+
+// Exposition
+
+// Write every metric in Prometheus' text format
+func (s *Registry) Write(w io.Writer) error {
+	s.mu.Lock()
+	families := make([]*family, 0, len(s.families))
+	for _, f := range s.families {
+		families = append(families, f)
+	}
+	s.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (s *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.Write(w)
+	})
+}
+
+// Serves `Default`
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+func (s *family) write(w *bufio.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.series) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n", s.name, escapeHelp(s.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", s.name, s.typ)
+
+	keys := make([]string, 0, len(s.series))
+	for k := range s.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		ser := s.series[k]
+		if s.typ != typeHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", s.name, s.labelString(ser.labels, ""), formatFloat(ser.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, le := range s.buckets {
+			cumulative += ser.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", s.name, s.labelString(ser.labels, formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", s.name, s.labelString(ser.labels, "+Inf"), ser.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", s.name, s.labelString(ser.labels, ""), formatFloat(ser.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", s.name, s.labelString(ser.labels, ""), ser.count)
+	}
+}
+
+// `{a="1",b="2"}`, with `le` appended if set
+func (s *family) labelString(values []string, le string) string {
+	if len(values) == 0 && le == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range s.labels {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(values[i]))
+		sb.WriteByte('"')
+	}
+	if le != "" {
+		if len(s.labels) > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(`le="`)
+		sb.WriteString(le)
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	events := r.NewCounter("events_total", "Events seen", "code", "action")
+	connected := r.NewGauge("connected", "Is \\ connected")
+	latency := r.NewHistogram("latency_seconds", "Latency", []float64{0.1, 1}, "endpoint")
+	r.NewCounter("unused_total", "Never observed")
+
+	events.With("VideoMotion", "Start").Inc()
+	events.With("VideoMotion", "Start").Add(2)
+	events.With("Say \"hi\"", "Pulse").Inc()
+	connected.With().Set(1)
+	latency.With("/a").Observe(0.05)
+	latency.With("/a").Observe(0.5)
+	latency.With("/a").Observe(5)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, `# HELP connected Is \\ connected
+# TYPE connected gauge
+connected 1
+# HELP events_total Events seen
+# TYPE events_total counter
+events_total{code="Say \"hi\"",action="Pulse"} 1
+events_total{code="VideoMotion",action="Start"} 3
+# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="/a",le="0.1"} 1
+latency_seconds_bucket{endpoint="/a",le="1"} 2
+latency_seconds_bucket{endpoint="/a",le="+Inf"} 3
+latency_seconds_sum{endpoint="/a"} 5.55
+latency_seconds_count{endpoint="/a"} 3
+`, buf.String())
+}
+
+func TestRegistryMisuse(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("a_total", "A", "code")
+
+	assert.Panics(t, func() { r.NewGauge("a_total", "Again") })
+	assert.Panics(t, func() { c.With("x", "y") })
+
+	c.With("x").Add(-1)
+	var buf bytes.Buffer
+	r.Write(&buf)
+	assert.Contains(t, buf.String(), `a_total{code="x"} 0`)
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("hits_total", "Hits").With().Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "version=0.0.4")
+	assert.Contains(t, rec.Body.String(), "hits_total 1\n")
+}
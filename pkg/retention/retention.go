@@ -0,0 +1,158 @@
+package retention
+
+import (
+	"ha-adapters/pkg/xlog"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Retention prunes a directory tree (eg. downloaded media) to stay within limits,
+removing the oldest files first. Any limit left at zero is ignored
+*/
+
+var log = xlog.Component("retention")
+
+type Policy struct {
+	MaxAge   time.Duration
+	MaxBytes int64
+	MaxFiles int
+
+	// Which files are ours to prune, by their slash-separated path relative to
+	// the root. Anything else is neither counted nor removed. nil for every file
+	Match func(rel string) bool
+}
+
+type Usage struct {
+	Files int
+	Bytes int64
+}
+
+type Result struct {
+	Usage        // Usage after pruning
+	Removed      int
+	RemovedBytes int64
+}
+
+type file struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Enforce removes files under `root` until `policy` is satisfied, oldest first,
+// then removes any directories left empty (never `root` itself)
+func Enforce(root string, policy Policy, now time.Time) (ret Result, err error) {
+	files, err := scan(root, policy.Match)
+	if err != nil {
+		return ret, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	usage := usageOf(files)
+	removedDirs := make(map[string]struct{})
+
+	for _, f := range files {
+		expired := policy.MaxAge > 0 && now.Sub(f.modTime) > policy.MaxAge
+		overBytes := policy.MaxBytes > 0 && usage.Bytes > policy.MaxBytes
+		overFiles := policy.MaxFiles > 0 && usage.Files > policy.MaxFiles
+		if !expired && !overBytes && !overFiles {
+			break // Sorted, so everything after is newer
+		}
+
+		log.Debugf("Retention removing %s", f.path)
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Unable to remove %s: %v", f.path, err)
+			continue
+		}
+
+		usage.Files--
+		usage.Bytes -= f.size
+		ret.Removed++
+		ret.RemovedBytes += f.size
+		removedDirs[filepath.Dir(f.path)] = struct{}{}
+	}
+
+	for dir := range removedDirs {
+		removeEmptyParents(root, dir)
+	}
+
+	ret.Usage = usage
+	return ret, nil
+}
+
+// Run `Enforce` now, and then every `interval` until `stop` is closed. `report` is
+// called with the outcome of every run
+func Run(root string, policy Policy, interval time.Duration, stop <-chan struct{}, report func(Result, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		result, err := Enforce(root, policy, time.Now())
+		if report != nil {
+			report(result, err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func scan(root string, match func(rel string) bool) (files []file, err error) {
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir // Nothing written yet
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || isPartial(d.Name()) {
+			return nil
+		}
+		if match != nil {
+			rel, err := filepath.Rel(root, path)
+			if err != nil || !match(filepath.ToSlash(rel)) {
+				return nil
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // Removed while walking
+		}
+		files = append(files, file{path, info.Size(), info.ModTime()})
+		return nil
+	})
+	return
+}
+
+// In-progress downloads are hidden temp files, and are left alone
+func isPartial(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".tmp")
+}
+
+func usageOf(files []file) (ret Usage) {
+	for _, f := range files {
+		ret.Files++
+		ret.Bytes += f.size
+	}
+	return
+}
+
+func removeEmptyParents(root, dir string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return // Not empty (or not ours)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package retention
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testNow = time.Date(2023, 1, 20, 12, 0, 0, 0, time.UTC)
+
+func writeFile(t *testing.T, root, name string, size int, age time.Duration) string {
+	path := filepath.Join(root, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0770))
+	require.NoError(t, os.WriteFile(path, make([]byte, size), 0660))
+	mod := testNow.Add(-age)
+	require.NoError(t, os.Chtimes(path, mod, mod))
+	return path
+}
+
+func TestEnforceMaxAge(t *testing.T) {
+	root := t.TempDir()
+	old := writeFile(t, root, "2023-01-01/a.jpg", 10, 19*24*time.Hour)
+	recent := writeFile(t, root, "2023-01-20/b.jpg", 10, time.Hour)
+
+	result, err := Enforce(root, Policy{MaxAge: 7 * 24 * time.Hour}, testNow)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Removed)
+	assert.Equal(t, Usage{1, 10}, result.Usage)
+
+	assert.NoFileExists(t, old)
+	assert.NoDirExists(t, filepath.Dir(old), "empty dir pruned")
+	assert.FileExists(t, recent)
+	assert.DirExists(t, root)
+}
+
+func TestEnforceMaxBytesAndFiles(t *testing.T) {
+	root := t.TempDir()
+	a := writeFile(t, root, "a.jpg", 100, 3*time.Hour)
+	b := writeFile(t, root, "b.jpg", 100, 2*time.Hour)
+	c := writeFile(t, root, "c.jpg", 100, 1*time.Hour)
+
+	result, err := Enforce(root, Policy{MaxBytes: 250}, testNow)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Removed)
+	assert.Equal(t, int64(100), result.RemovedBytes)
+	assert.NoFileExists(t, a)
+
+	result, err = Enforce(root, Policy{MaxFiles: 1}, testNow)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Removed)
+	assert.NoFileExists(t, b)
+	assert.FileExists(t, c)
+}
+
+func TestEnforceSkipsPartial(t *testing.T) {
+	root := t.TempDir()
+	partial := writeFile(t, root, ".a.jpg.1234.tmp", 100, 48*time.Hour)
+
+	result, err := Enforce(root, Policy{MaxAge: time.Hour}, testNow)
+	require.NoError(t, err)
+	assert.Equal(t, Usage{}, result.Usage)
+	assert.FileExists(t, partial)
+}
+
+func TestEnforceMatch(t *testing.T) {
+	root := t.TempDir()
+	media := writeFile(t, root, "doorbell/a.jpg", 10, 48*time.Hour)
+	other := writeFile(t, root, "notes.txt", 10, 48*time.Hour)
+	otherDir := writeFile(t, root, "photos/b.jpg", 10, 48*time.Hour)
+
+	policy := Policy{
+		MaxAge: time.Hour,
+		Match:  func(rel string) bool { return strings.HasPrefix(rel, "doorbell/") },
+	}
+	result, err := Enforce(root, policy, testNow)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Removed)
+	assert.Equal(t, Usage{}, result.Usage, "only matching files count")
+	assert.NoFileExists(t, media)
+	assert.FileExists(t, other)
+	assert.FileExists(t, otherDir)
+}
+
+func TestEnforceMissingRoot(t *testing.T) {
+	result, err := Enforce(filepath.Join(t.TempDir(), "nope"), Policy{MaxFiles: 1}, testNow)
+	assert.NoError(t, err)
+	assert.Equal(t, Result{}, result)
+}
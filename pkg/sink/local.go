@@ -0,0 +1,41 @@
+package sink
+
+import (
+	"fmt"
+	"ha-adapters/pkg/xfs"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Local struct {
+	Root string
+}
+
+var _ Sink = &Local{}
+
+func NewLocal(root string) *Local {
+	return &Local{root}
+}
+
+// Written to a temp file alongside the destination, and renamed into place once complete
+func (s *Local) Put(key string, body io.ReadSeeker, size int64) error {
+	rel := filepath.Clean(filepath.FromSlash(key))
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return fmt.Errorf("key %q is outside of %s", key, s.Root)
+	}
+
+	to := filepath.Join(s.Root, rel)
+	return xfs.WriteAtomic(to, func(f *os.File) error {
+		n, err := io.Copy(f, body)
+		if err == nil && size >= 0 && n != size {
+			err = fmt.Errorf("short write: %d of %d bytes", n, size)
+		}
+		return err
+	})
+}
+
+func (s *Local) String() string {
+	return "file://" + s.Root
+}
@@ -0,0 +1,36 @@
+package sink
+
+import (
+	"ha-adapters/pkg/comms"
+	"io"
+	"strings"
+)
+
+// Mqtt publishes images (only) as raw bytes to a single topic, eg. for an
+// MQTT camera entity. Anything else is skipped
+type Mqtt struct {
+	publisher comms.Publisher
+	Topic     string
+}
+
+var _ Sink = &Mqtt{}
+
+func NewMqtt(publisher comms.Publisher, topic string) *Mqtt {
+	return &Mqtt{publisher, topic}
+}
+
+func (s *Mqtt) Put(key string, body io.ReadSeeker, size int64) error {
+	if !strings.HasPrefix(contentType(key), "image/") {
+		return nil
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return s.publisher.Publish(s.Topic, data)
+}
+
+func (s *Mqtt) String() string {
+	return "mqtt://" + s.Topic
+}
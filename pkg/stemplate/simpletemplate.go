@@ -1,6 +1,9 @@
 package stemplate
 
 import (
+	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"text/template"
 	"time"
@@ -9,11 +12,31 @@ import (
 )
 
 type STemplate struct {
+	text string
 	tmpl *template.Template
 }
 
 var helpers = template.FuncMap{
-	"now": time.Now,
+	"now":      time.Now,
+	"date":     formatDate,
+	"sanitize": sanitize,
+}
+
+// eg. `{{ .Time | date "2006-01-02" }}`
+func formatDate(layout string, t time.Time) string {
+	return t.Format(layout)
+}
+
+var sanitizeRegex = regexp.MustCompile(`[^a-zA-Z0-9._\-]+`)
+
+// Make a string safe to use as a single path component
+func sanitize(s string) string {
+	s = sanitizeRegex.ReplaceAllString(s, "_")
+	s = strings.Trim(s, "_")
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return s
 }
 
 func New(text string) (*STemplate, error) {
@@ -23,6 +46,7 @@ func New(text string) (*STemplate, error) {
 	}
 
 	return &STemplate{
+		text,
 		t,
 	}, nil
 }
@@ -43,3 +67,58 @@ func (s *STemplate) Execute(data any) string {
 	}
 	return out.String()
 }
+
+func (s *STemplate) String() string {
+	return s.text
+}
+
+// Directory that all paths generated by the template live under, ie. the
+// directory part of the text preceding the first action
+func (s *STemplate) RootDir() string {
+	prefix := s.text
+	if idx := strings.Index(prefix, "{{"); idx >= 0 {
+		prefix = prefix[:idx]
+	}
+	if strings.HasSuffix(prefix, "/") {
+		return filepath.Clean(prefix)
+	}
+	return filepath.Dir(prefix)
+}
+
+var actionRegex = regexp.MustCompile(`\{\{.*?\}\}`)
+
+// Matches the paths, relative to `RootDir` and slash-separated, that the
+// template could produce. Actions could be anything, so match anything
+func (s *STemplate) KeyPattern() *regexp.Regexp {
+	return keyPattern(s.keyLiterals())
+}
+
+// Like `KeyPattern`, for paths that had their extension swapped for `ext`
+// afterwards, eg. clips remuxed to .mp4. Text ending in an action already
+// matches any extension
+func (s *STemplate) KeyPatternWithExt(ext string) *regexp.Regexp {
+	literals := s.keyLiterals()
+	last := literals[len(literals)-1]
+	if old := path.Ext(last); old != "" {
+		literals[len(literals)-1] = strings.TrimSuffix(last, old) + ext
+	}
+	return keyPattern(literals)
+}
+
+// The template's text relative to `RootDir`, split around its actions
+func (s *STemplate) keyLiterals() []string {
+	rel := filepath.ToSlash(s.text)
+	if root := filepath.ToSlash(s.RootDir()); root != "." {
+		rel = strings.TrimPrefix(rel, strings.TrimSuffix(root, "/")+"/")
+	}
+	rel = strings.TrimPrefix(rel, "./")
+	return actionRegex.Split(rel, -1)
+}
+
+func keyPattern(literals []string) *regexp.Regexp {
+	quoted := make([]string, len(literals))
+	for i, lit := range literals {
+		quoted[i] = regexp.QuoteMeta(lit)
+	}
+	return regexp.MustCompile("^" + strings.Join(quoted, ".+") + "$")
+}
@@ -0,0 +1,50 @@
+package stemplate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRootDir(t *testing.T) {
+	assert.Equal(t, "/media", MustNew("/media/{{ now.Unix }}.jpg").RootDir())
+	assert.Equal(t, "/media", MustNew("/media/doorbell-{{ now.Unix }}.jpg").RootDir())
+	assert.Equal(t, "/media/a", MustNew("/media/a/").RootDir())
+	assert.Equal(t, ".", MustNew("{{ now.Unix }}.jpg").RootDir())
+}
+
+func TestKeyPattern(t *testing.T) {
+	pattern := MustNew(`/media/{{.Device}}/{{ .Time | date "2006-01-02" }}/{{.Event}}-{{.Base}}.jpg`).KeyPattern()
+	assert.True(t, pattern.MatchString("Doorbell/2023-01-20/NewFile-56.jpg"))
+	assert.False(t, pattern.MatchString("Doorbell/2023-01-20/NewFile56.jpg"))
+	assert.False(t, pattern.MatchString("notes.txt"))
+
+	pattern = MustNew(`/home/user/{{.Device}}.jpg`).KeyPattern()
+	assert.True(t, pattern.MatchString("Doorbell.jpg"))
+	assert.False(t, pattern.MatchString("holiday.png"))
+
+	assert.True(t, MustNew(`{{.Base}}`).KeyPattern().MatchString("a/b"))
+}
+
+func TestKeyPatternWithExt(t *testing.T) {
+	pattern := MustNew(`/media/{{.Device}}-{{.Base}}.jpg`).KeyPatternWithExt(".mp4")
+	assert.True(t, pattern.MatchString("Doorbell-clip.mp4"))
+	assert.False(t, pattern.MatchString("Doorbell-clip.jpg"))
+	assert.False(t, pattern.MatchString("Doorbell-clipxmp4"))
+
+	// Already matches whatever extension the action gives
+	pattern = MustNew(`/media/{{.Device}}/{{.Base}}{{.Ext}}`).KeyPatternWithExt(".mp4")
+	assert.True(t, pattern.MatchString("Doorbell/clip.mp4"))
+}
+
+func TestHelpers(t *testing.T) {
+	tmpl := MustNew(`{{ .Time | date "2006-01-02" }}/{{ .Name | sanitize }}`)
+	assert.Equal(t, "2023-01-20/10.56.56-10.57.44_M_0_0_0_.mp4", tmpl.Execute(map[string]interface{}{
+		"Time": time.Date(2023, 1, 20, 12, 0, 0, 0, time.UTC),
+		"Name": "10.56.56-10.57.44[M][0@0][0].mp4",
+	}))
+
+	assert.Equal(t, "_", sanitize(".."))
+	assert.Equal(t, "a_b", sanitize("a/b"))
+}
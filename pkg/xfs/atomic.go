@@ -0,0 +1,40 @@
+package xfs
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Write to a temp file alongside `to`, and rename into place only if `write`
+// succeeds; so `to` is never seen half-written
+func WriteAtomic(to string, write func(f *os.File) error) error {
+	dir := filepath.Dir(to)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(to)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, 0660)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, to)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package xfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	to := filepath.Join(dir, "a", "b.txt")
+
+	require.NoError(t, WriteAtomic(to, func(f *os.File) error {
+		_, err := f.WriteString("hello")
+		return err
+	}))
+	data, err := os.ReadFile(to)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// Failures leave the old file, and no temp file, behind
+	failed := errors.New("failed")
+	err = WriteAtomic(to, func(f *os.File) error {
+		f.WriteString("partial")
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+	data, _ = os.ReadFile(to)
+	assert.Equal(t, "hello", string(data))
+	entries, _ := os.ReadDir(filepath.Join(dir, "a"))
+	assert.Len(t, entries, 1)
+}
@@ -45,6 +45,11 @@ func (s *AutoRetry) Do(req *http.Request) (*http.Response, error) {
 		// Didn't get the result we expected, cleanup and try again
 		resp.Body.Close()
 
+		// ...unless it's our fault (not found, bad password etc.)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return nil, &StatusError{resp.StatusCode}
+		}
+
 		if i >= s.RetryCount {
 			return nil, ErrorExceedsRetry
 		}
@@ -37,14 +37,15 @@ func (s *HttpDigestSession) Do(req *http.Request) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer resp0.Body.Close()
 
-	if resp0.StatusCode != http.StatusUnauthorized {
-		return nil, fmt.Errorf("expecting unauthorized, got %d", resp0.StatusCode)
+	// eg. a 404, which doesn't need auth to tell us; it's the caller's
+	digest := parseDigest(resp0)
+	if resp0.StatusCode != http.StatusUnauthorized || digest["nonce"] == "" {
+		return resp0, nil
 	}
+	resp0.Body.Close()
 
 	// Modify request with digest auth
-	digest := parseDigest(resp0)
 	reqUri := req.URL.RequestURI()
 
 	if s.authHash == "" {
@@ -59,6 +60,13 @@ func (s *HttpDigestSession) Do(req *http.Request) (*http.Response, error) {
 
 	req.Header.Set("Authorization", digestHeader)
 
+	// The first request used up the body
+	if req.Body != nil && req.GetBody != nil {
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
 	// Make another request with digest auth
 	resp1, err := s.client.Do(req)
 	if err != nil {
@@ -0,0 +1,60 @@
+package xhttp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigest(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch {
+		case r.URL.Path == "/missing":
+			http.Error(w, "not here", http.StatusNotFound)
+		case r.URL.Path == "/basic":
+			w.Header().Set("WWW-Authenticate", `Basic realm="x"`)
+			http.Error(w, "nope", http.StatusUnauthorized)
+		case !strings.HasPrefix(r.Header.Get("Authorization"), "Digest "):
+			w.Header().Set("WWW-Authenticate", `Digest realm="x", qop="auth", nonce="abc"`)
+			http.Error(w, "challenge", http.StatusUnauthorized)
+		default:
+			io.WriteString(w, "ok")
+		}
+	}))
+	defer srv.Close()
+	digest := NewDigest(http.DefaultClient, "admin", "password")
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := digest.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// Challenged, then authorized
+	status, body := get("/ok")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// No challenge; the first response is passed through as-is
+	for _, path := range []string{"/missing", "/basic"} {
+		atomic.StoreInt32(&requests, 0)
+		status, body = get(path)
+		assert.NotEqual(t, http.StatusOK, status, path)
+		assert.NotEmpty(t, body, path)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&requests), path)
+	}
+}
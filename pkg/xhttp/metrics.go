@@ -0,0 +1,71 @@
+package xhttp
+
+import (
+	"ha-adapters/pkg/metrics"
+	"ha-adapters/pkg/xlog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = xlog.Component("xhttp")
+
+var (
+	metricRequests = metrics.NewCounter("http_client_requests_total",
+		"HTTP requests made, by status code (or error)", "client", "method", "endpoint", "status")
+	metricRequestDuration = metrics.NewHistogram("http_client_request_duration_seconds",
+		"Time until response headers", nil, "client", "method", "endpoint")
+)
+
+// Records each request's latency and status. Wrap the innermost client, so
+// every round trip (eg. digest's 401) is counted
+type Instrumented struct {
+	client XHttp
+	name   string
+
+	// Endpoint label for a request; defaults to its path. Paths must be few,
+	// so clients with per-file paths should use `NoEndpoint`
+	Endpoint func(req *http.Request) string
+}
+
+func NewInstrumented(client XHttp, name string) *Instrumented {
+	return &Instrumented{
+		client,
+		name,
+		nil,
+	}
+}
+
+func NoEndpoint(req *http.Request) string {
+	return ""
+}
+
+func (s *Instrumented) Do(req *http.Request) (*http.Response, error) {
+	endpoint := req.URL.Path
+	if s.Endpoint != nil {
+		endpoint = s.Endpoint(req)
+	}
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	metricRequestDuration.With(s.name, req.Method, endpoint).ObserveSince(start)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	metricRequests.With(s.name, req.Method, endpoint, status).Inc()
+	if log.Logger.IsLevelEnabled(logrus.TraceLevel) {
+		log.WithFields(logrus.Fields{
+			"client":   s.name,
+			"method":   req.Method,
+			"url":      req.URL.String(),
+			"status":   status,
+			"duration": time.Since(start),
+		}).Trace("HTTP request")
+	}
+
+	return resp, err
+}
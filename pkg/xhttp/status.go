@@ -0,0 +1,21 @@
+package xhttp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A response whose status wasn't what the caller expected
+type StatusError struct {
+	StatusCode int
+}
+
+func (s *StatusError) Error() string {
+	return fmt.Sprintf("http error %d", s.StatusCode)
+}
+
+// A 4xx; asking again won't help
+func IsClientError(err error) bool {
+	var status *StatusError
+	return errors.As(err, &status) && status.StatusCode >= 400 && status.StatusCode < 500
+}
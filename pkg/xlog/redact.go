@@ -0,0 +1,120 @@
+package xlog
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Masks secrets in log output: credentials in URLs, Authorization & digest
+headers, and the values of sensitive keys wherever they appear (query
+strings, `key=value` payloads, JSON and log fields)
+*/
+
+const redacted = "***"
+
+// Key names are sensitive if they contain any of these, case-insensitively
+var DefaultSensitiveKeys = []string{
+	"password", "passwd", "pwd", "secret", "token", "apikey", "api_key",
+	"access_key", "accesskey", "credential", "signature", "authorization",
+}
+
+type Redactor struct {
+	keyName  *regexp.Regexp
+	patterns []redaction
+}
+
+type redaction struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+var (
+	urlUserinfo = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.\-]*://[^:/@\s]*):[^@/\s]*@`)
+	authHeader  = regexp.MustCompile(`(?i)\b((?:proxy-)?(?:www-)?authori[sz]ation\s*:\s*)[^\r\n]+`)
+	// Schemes with a credential after them, not just the word "digest"
+	authScheme = regexp.MustCompile(`(?i)\b(Basic|Bearer)\s+[A-Za-z0-9+/=._\-]{8,}|\b(Digest)\s+\w+=[^\r\n]*`)
+)
+
+func NewRedactor(keys []string) *Redactor {
+	quoted := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if k = strings.TrimSpace(k); k != "" {
+			quoted = append(quoted, regexp.QuoteMeta(k))
+		}
+	}
+
+	ret := &Redactor{
+		patterns: []redaction{
+			{urlUserinfo, "${1}:" + redacted + "@"},
+			{authHeader, "${1}" + redacted},
+			{authScheme, "${1}${2} " + redacted},
+		},
+	}
+	if len(quoted) == 0 {
+		return ret
+	}
+
+	key := `[\w.\-\[\]]*(?:` + strings.Join(quoted, "|") + `)[\w.\-\[\]]*`
+	ret.keyName = regexp.MustCompile(`(?i)^` + key + `$`)
+	ret.patterns = append(ret.patterns,
+		// "key": "value"
+		redaction{regexp.MustCompile(`(?i)("` + key + `"\s*:\s*)"(?:[^"\\]|\\.)*"`), `${1}"` + redacted + `"`},
+		// key=value, as in query strings and `table.X.Password=...`
+		redaction{regexp.MustCompile(`(?i)(` + key + `=)[^&;,\s"']+`), "${1}" + redacted},
+	)
+	return ret
+}
+
+func (s *Redactor) Redact(text string) string {
+	for _, p := range s.patterns {
+		text = p.re.ReplaceAllString(text, p.repl)
+	}
+	return text
+}
+
+// Whether a field's value should be masked outright, by its name
+func (s *Redactor) SensitiveKey(name string) bool {
+	return s.keyName != nil && s.keyName.MatchString(name)
+}
+
+// Wraps a formatter, redacting the message and fields before formatting
+type RedactingFormatter struct {
+	Formatter logrus.Formatter
+	Redactor  *Redactor
+}
+
+func NewRedactingFormatter(formatter logrus.Formatter, keys []string) *RedactingFormatter {
+	return &RedactingFormatter{formatter, NewRedactor(keys)}
+}
+
+func (s *RedactingFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	// Don't modify the caller's entry; its fields may be shared
+	dup := *e
+	dup.Message = s.Redactor.Redact(e.Message)
+	dup.Data = make(logrus.Fields, len(e.Data))
+	for k, v := range e.Data {
+		dup.Data[k] = s.redactField(k, v)
+	}
+	return s.Formatter.Format(&dup)
+}
+
+func (s *RedactingFormatter) redactField(name string, val interface{}) interface{} {
+	if s.Redactor.SensitiveKey(name) {
+		return redacted
+	}
+	switch v := val.(type) {
+	case string:
+		return s.Redactor.Redact(v)
+	case []byte:
+		return s.Redactor.Redact(string(v))
+	case error:
+		return s.Redactor.Redact(v.Error())
+	case *url.URL:
+		return s.Redactor.Redact(v.String())
+	}
+	return val
+}
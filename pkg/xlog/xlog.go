@@ -0,0 +1,138 @@
+package xlog
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Per-component loggers. Each component (eg. "amcrest", "xhttp") has its own
+logrus logger, so its level can be set on its own, but shares the standard
+logger's output, formatter and hooks; set those on logrus as usual
+*/
+
+var (
+	mu        sync.Mutex
+	loggers   = make(map[string]*logrus.Logger)
+	overrides = make(map[string]logrus.Level)
+)
+
+// Logger for a component, with a `component` field. Add more fields (eg. a
+// device's serial) with `WithField`
+func Component(name string) *logrus.Entry {
+	return componentLogger(name).WithField("component", name)
+}
+
+func componentLogger(name string) *logrus.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if l, ok := loggers[name]; ok {
+		return l
+	}
+
+	std := logrus.StandardLogger()
+	level, ok := overrides[name]
+	if !ok {
+		level = std.GetLevel()
+	}
+	l := &logrus.Logger{
+		Out:       stdWriter{},
+		Formatter: stdFormatter{},
+		Hooks:     std.Hooks,
+		Level:     level,
+		ExitFunc:  os.Exit,
+	}
+	loggers[name] = l
+	return l
+}
+
+// Set the level of the standard logger, and every component without its own
+func SetLevel(level logrus.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	logrus.SetLevel(level)
+	for name, l := range loggers {
+		if _, ok := overrides[name]; !ok {
+			l.SetLevel(level)
+		}
+	}
+}
+
+// Set a component's level, regardless of the standard logger's
+func SetComponentLevel(name string, level logrus.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	overrides[name] = level
+	if l, ok := loggers[name]; ok {
+		l.SetLevel(level)
+	}
+}
+
+// Components created so far
+func Components() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	ret := make([]string, 0, len(loggers))
+	for name := range loggers {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Parse `component=level,...`, eg. `xhttp=trace,mqtt=debug`. If any `known`
+// components are given, others are rejected, so typos don't go unnoticed
+func ParseLevels(spec string, known ...string) (map[string]logrus.Level, error) {
+	ret := make(map[string]logrus.Level)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, levelName, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid component level %q, expected component=level", item)
+		}
+		name = strings.TrimSpace(name)
+		if len(known) > 0 && !contains(known, name) {
+			return nil, fmt.Errorf("unknown log component %q, expected one of: %s", name, strings.Join(known, ", "))
+		}
+		level, err := logrus.ParseLevel(strings.TrimSpace(levelName))
+		if err != nil {
+			return nil, err
+		}
+		ret[name] = level
+	}
+	return ret, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Defer to whatever the standard logger is set to at the time
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	return logrus.StandardLogger().Out.Write(p)
+}
+
+type stdFormatter struct{}
+
+func (stdFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	return logrus.StandardLogger().Formatter.Format(e)
+}
@@ -0,0 +1,69 @@
+package xlog
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComponentLevels(t *testing.T) {
+	var buf bytes.Buffer
+	std := logrus.StandardLogger()
+	oldOut, oldFormatter, oldLevel := std.Out, std.Formatter, std.GetLevel()
+	defer func() {
+		std.SetOutput(oldOut)
+		std.SetFormatter(oldFormatter)
+		SetLevel(oldLevel)
+	}()
+
+	a := Component("test-a").WithField("serial", "SN1")
+	b := Component("test-b")
+
+	// Output & formatter are whatever the standard logger has, even if set later
+	std.SetOutput(&buf)
+	std.SetFormatter(&logrus.JSONFormatter{DisableTimestamp: true})
+	SetLevel(logrus.InfoLevel)
+	SetComponentLevel("test-b", logrus.TraceLevel)
+
+	a.Debug("hidden")
+	a.Info("shown")
+	b.Trace("traced")
+	assert.Equal(t, `{"component":"test-a","level":"info","msg":"shown","serial":"SN1"}
+{"component":"test-b","level":"trace","msg":"traced"}
+`, buf.String())
+
+	// Overridden components keep their level
+	buf.Reset()
+	SetLevel(logrus.ErrorLevel)
+	a.Info("hidden")
+	b.Debug("still traced")
+	assert.Contains(t, buf.String(), "still traced")
+	assert.NotContains(t, buf.String(), "hidden")
+
+	assert.Contains(t, Components(), "test-a")
+}
+
+func TestParseLevels(t *testing.T) {
+	levels, err := ParseLevels(" xhttp=trace, mqtt=DEBUG,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]logrus.Level{"xhttp": logrus.TraceLevel, "mqtt": logrus.DebugLevel}, levels)
+
+	levels, err = ParseLevels("")
+	require.NoError(t, err)
+	assert.Empty(t, levels)
+
+	_, err = ParseLevels("xhttp")
+	assert.Error(t, err)
+	_, err = ParseLevels("xhttp=loud")
+	assert.Error(t, err)
+
+	// Only known components, if given
+	levels, err = ParseLevels("xhttp=trace", "amcrest", "xhttp")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]logrus.Level{"xhttp": logrus.TraceLevel}, levels)
+	_, err = ParseLevels("xhtp=trace", "amcrest", "xhttp")
+	assert.ErrorContains(t, err, `unknown log component "xhtp"`)
+}